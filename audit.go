@@ -0,0 +1,119 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Key    string    `json:"key"`
+	NewKey string    `json:"new_key,omitempty"`
+	Uid    uint32    `json:"uid"`
+	Gid    uint32    `json:"gid"`
+	Pid    uint32    `json:"pid"`
+	Size   int64     `json:"size,omitempty"`
+	Ok     bool      `json:"ok"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Audit writes a json record for every mutating operation on the mount, and optionally reads.
+// A nil *Audit discards everything.
+type Audit struct {
+	mu sync.Mutex
+	// nil once closed
+	out   io.Writer
+	reads bool
+}
+
+// NewAudit returns an audit log writing to dest, which is a file path, stderr or syslog.
+// It returns nil if dest is empty.
+func NewAudit(dest string, reads bool) (*Audit, error) {
+	var out io.Writer
+	switch dest {
+	case "":
+		return nil, nil
+	case "stderr":
+		out = os.Stderr
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "kvfs")
+		if err != nil {
+			return nil, err
+		}
+		out = w
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return &Audit{out: out, reads: reads}, nil
+}
+
+func (a *Audit) write(r *AuditRecord, h *fuse.Header, err error) {
+	if a == nil {
+		return
+	}
+	r.Time = time.Now()
+	r.Uid, r.Gid, r.Pid = h.Uid, h.Gid, h.Pid
+	r.Ok = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+	line, e := json.Marshal(r)
+	if e != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.out != nil {
+		a.out.Write(append(line, '\n'))
+	}
+}
+
+// Close closes the audit log file or syslog connection.  Later records are discarded.
+func (a *Audit) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := a.out
+	a.out = nil
+	if closer, is := out.(io.Closer); is && out != os.Stderr {
+		return closer.Close()
+	}
+	return nil
+}
+
+// op records a mutating operation.  Use as defer f.audit.op("Create", &req.Header, key, &err)
+func (a *Audit) op(op string, h *fuse.Header, key string, err *error) {
+	a.write(&AuditRecord{Op: op, Key: key}, h, *err)
+}
+
+// sized records a mutating operation that has a size, e.g. the number of bytes flushed.
+func (a *Audit) sized(op string, h *fuse.Header, key string, size int64, err error) {
+	a.write(&AuditRecord{Op: op, Key: key, Size: size}, h, err)
+}
+
+// read records a read, if reads are audited.
+func (a *Audit) read(op string, h *fuse.Header, key string, size int64, err error) {
+	if a == nil || !a.reads {
+		return
+	}
+	a.write(&AuditRecord{Op: op, Key: key, Size: size}, h, err)
+}
+
+func (a *Audit) rename(h *fuse.Header, key, newKey string, err *error) {
+	a.write(&AuditRecord{Op: "Rename", Key: key, NewKey: newKey}, h, *err)
+}
@@ -0,0 +1,40 @@
+package kvfs
+
+import (
+	"bazil.org/fuse"
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+type TestSuiteAudit struct{}
+
+var _ = Suite(&TestSuiteAudit{})
+
+func (suite *TestSuiteAudit) TestClose(c *C) {
+	path := filepath.Join(c.MkDir(), "audit.log")
+	a, err := NewAudit(path, false)
+	c.Assert(err, IsNil)
+
+	var opErr error
+	a.op("Create", &fuse.Header{Uid: 1000}, "app/port", &opErr)
+	c.Assert(a.Close(), IsNil)
+	// discarded
+	a.op("Remove", &fuse.Header{Uid: 1000}, "app/port", &opErr)
+
+	buff, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(buff)), "\n")
+	c.Assert(len(lines), Equals, 1)
+	r := &AuditRecord{}
+	c.Assert(json.Unmarshal([]byte(lines[0]), r), IsNil)
+	c.Assert(r.Op, Equals, "Create")
+	c.Assert(r.Key, Equals, "app/port")
+	c.Assert(r.Uid, Equals, uint32(1000))
+	c.Assert(r.Ok, Equals, true)
+
+	var none *Audit
+	c.Assert(none.Close(), IsNil)
+}
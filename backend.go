@@ -12,13 +12,23 @@ import (
 )
 
 type NameFromKeyFunc func(parent string, key string) (name string)
+type PathFromKeyFunc func(parent string, key string) (path string)
 type DeleteEmptyParentFunc func(store store.Store, key string) error
+type StoreUsageFunc func(url *net.URL, tls *tls.Config) (*StoreUsage, error)
 
 // Sadly libkv doesn't not abstract away the differences in handling the keys and other behaviors
 // So we'd have to create something like this to make sure things work across different kvstores.
 type Handler struct {
 	NameFromKey       NameFromKeyFunc
+	PathFromKey       PathFromKeyFunc
 	DeleteEmptyParent DeleteEmptyParentFunc
+	// Deletes a directory and everything below it in one go, instead of entry by entry; nil for
+	// most kv stores
+	DeleteDir DeleteEmptyParentFunc
+	// nil if the kv store can't report its usage
+	StoreUsage StoreUsageFunc
+	// Largest value the kv store accepts by default
+	MaxValueSize int
 }
 
 type Backend struct {
@@ -26,6 +36,34 @@ type Backend struct {
 	Url     *net.URL
 	Root    []string
 	Handler *Handler
+	Stats   *Stats
+	Breaker *Breaker
+
+	tls *tls.Config
+	// lower layers of a union, top first
+	lower []*net.URL
+}
+
+// String returns the url of the backend without any credentials.
+func (this *Backend) String() string {
+	u := *this.Url
+	u.User = nil
+	u.RawQuery = ""
+	s := u.String()
+	for _, lower := range this.lower {
+		l := *lower
+		l.User = nil
+		l.RawQuery = ""
+		s += " over " + l.String()
+	}
+	return s
+}
+
+// Ping checks that the kv store can be reached.
+func (this *Backend) Ping() error {
+	// Any key will do.  A missing key is still an answer from the kv store.
+	_, err := this.store.Exists(filepath.Join(append(append([]string{}, this.Root...), DirMarker)...))
+	return err
 }
 
 func (this *Backend) View(c context.Context, f func(Context) error) error {
@@ -51,6 +89,30 @@ type Config struct {
 	CACertFile        string `flag:"ca_cert, The CA cert file"`
 	TLS               *tls.Config
 	ConnectionTimeout time.Duration `flag:"timeout,The timeout"`
+	Templates         bool          `flag:"templates,Render *.tmpl keys as virtual files"`
+	MetricsAddr       string        `flag:"metrics,Address to serve prometheus metrics on, e.g. :9102"`
+	AuditLog          string        `flag:"audit,Audit log of changes made through the mount: a file path, stderr or syslog"`
+	AuditReads        bool          `flag:"audit_reads,Also audit opens and reads"`
+	Retries           int           `flag:"store_retries,Retries of a kv store call that failed because the store is unreachable"`
+	RetryWait         time.Duration `flag:"store_retry_wait,Wait before the first retry of a kv store call; doubles after each retry"`
+	BreakerThreshold  int           `flag:"breaker_threshold,Consecutive kv store failures before calls fail fast; 0 to disable"`
+	BreakerCooldown   time.Duration `flag:"breaker_cooldown,How long calls fail fast before the kv store is tried again"`
+	CacheSize         int           `flag:"cache_size,Number of values to cache in memory; 0 to disable the read cache"`
+	CacheDir          string        `flag:"cache_dir,Directory to also keep cached values in, so they survive restarts; needs cache_size"`
+	ServeStale        bool          `flag:"serve_stale,Serve the last cached value when the kv store is unreachable"`
+	CapacityBytes     uint64        `flag:"capacity_bytes,Size of the mount reported by statfs, e.g. to df; 0 for unlimited"`
+	CapacityKeys      uint64        `flag:"capacity_keys,Number of keys the mount can hold, reported by statfs; 0 for unlimited"`
+	StoreUsage        bool          `flag:"store_usage,Ask the kv store for its usage and capacity for statfs (zk mntr, etcd metrics)"`
+	CAS               bool          `flag:"cas,Fail writes to files changed in the kv store since they were read with ESTALE"`
+	WriteThrough      int           `flag:"write_through,Write to the kv store on every write once this many bytes are unwritten; 0 to write on flush and fsync only"`
+	History           int           `flag:"history,Number of previous values of each file to keep in the history; 0 to disable"`
+	JournalDir        string        `flag:"journal,Directory of the write-back journal for flushes made while the kv store is unreachable"`
+	Trash             bool          `flag:"trash,Move removed files and directories to the trash instead of deleting them"`
+	TrashRetention    time.Duration `flag:"trash_retention,How long entries are kept in the trash; 0 to keep them until the size limit is reached"`
+	TrashMaxBytes     uint64        `flag:"trash_max_bytes,Size of the trash above which the oldest entries are purged; 0 for unlimited"`
+	AllowOther        bool          `flag:"allow_other,Let other users access the mount"`
+	ReadOnly          bool          `flag:"read_only,Mount read-only"`
+	DirValues         string        `flag:"dir_values,Show the value of a key with keys below it as a .value file inside its directory (inside) or a <name>.value file next to it (sibling)"`
 }
 
 func NewBackend(url string, c *Config) (*Backend, error) {
@@ -58,6 +120,14 @@ func NewBackend(url string, c *Config) (*Backend, error) {
 	if err != nil {
 		return nil, err
 	}
+	s, h, err := GetStore(u, storeConfig(u, c))
+	if err != nil {
+		return nil, err
+	}
+	return newBackend(u, s, h, c), nil
+}
+
+func storeConfig(u *net.URL, c *Config) *store.Config {
 	config := &store.Config{
 		Bucket: u.Path,
 	}
@@ -71,29 +141,46 @@ func NewBackend(url string, c *Config) (*Backend, error) {
 		config.PersistConnection = true
 		config.ConnectionTimeout = c.ConnectionTimeout
 	}
+	return config
+}
 
+// rootOf returns the root of the url, without the leading /
+func rootOf(u *net.URL) string {
 	root := u.Path
 	if len(root) > 1 && root[0] == '/' {
 		root = root[1:]
 	}
+	return root
+}
 
+// newBackend wraps the kv store for retries and stats.
+func newBackend(u *net.URL, s store.Store, h *Handler, c *Config) *Backend {
+	root := rootOf(u)
 	backend := &Backend{
-		Url:  u,
-		Root: strings.Split(root, "/"),
+		Url:     u,
+		Root:    strings.Split(root, "/"),
+		Stats:   NewStats(),
+		Breaker: &Breaker{},
 	}
-
-	s, h, err := GetStore(u, config)
-	if err != nil {
-		return nil, err
+	retry := &retryStore{breaker: backend.Breaker}
+	if c != nil {
+		backend.tls = c.TLS
+		retry.retries = c.Retries
+		retry.wait = c.RetryWait
+		backend.Breaker.Threshold = c.BreakerThreshold
+		backend.Breaker.Cooldown = c.BreakerCooldown
 	}
-	backend.store = s
+
+	// Retries are counted as separate calls in the stats.
+	retry.Store = &statsStore{Store: s, stats: backend.Stats}
+	backend.store = retry
 	backend.Handler = h
 
 	// create the root dir
 	if root != "" {
 		backend.store.Put(root, []byte{}, nil) // ignore error here.
 	}
-	return backend, nil
+	return backend
 }
 
 func GetStore(u *net.URL, config *store.Config) (s store.Store, h *Handler, err error) {
@@ -106,9 +193,15 @@ func GetStore(u *net.URL, config *store.Config) (s store.Store, h *Handler, err
 				// Zk return the name, not the path.  So b in /a/b is just b
 				return key
 			},
+			PathFromKey: func(parent string, key string) (path string) {
+				return filepath.Join(parent, key)
+			},
 			DeleteEmptyParent: func(store store.Store, key string) error {
 				return store.Delete(key)
 			},
+			StoreUsage: zkStoreUsage,
+			// jute.maxbuffer
+			MaxValueSize: 1 << 20,
 		}
 	case "etcd":
 		s, err = libkv.NewStore(store.ETCD, hosts, config)
@@ -121,9 +214,15 @@ func GetStore(u *net.URL, config *store.Config) (s store.Store, h *Handler, err
 				return strings.Split(strings.Replace(key, parent+"/", "", 1), "/")[0]
 
 			},
+			PathFromKey: func(parent string, key string) (path string) {
+				return strings.TrimPrefix(key, "/")
+			},
 			DeleteEmptyParent: func(store store.Store, key string) error {
 				return store.DeleteTree(key)
 			},
+			StoreUsage: etcdStoreUsage,
+			// max request size
+			MaxValueSize: 1536 << 10,
 		}
 	case "consul":
 		s, err = libkv.NewStore(store.CONSUL, hosts, config)
@@ -132,9 +231,13 @@ func GetStore(u *net.URL, config *store.Config) (s store.Store, h *Handler, err
 				// Consul returns the full path but without the leading '/'.
 				return strings.Split(strings.Replace(key, parent+"/", "", 1), "/")[0]
 			},
+			PathFromKey: func(parent string, key string) (path string) {
+				return key
+			},
 			DeleteEmptyParent: func(store store.Store, key string) error {
 				return store.DeleteTree(key)
 			},
+			MaxValueSize: 512 << 10,
 		}
 	default:
 		s, err = nil, &ErrNotSupported{u.Scheme}
@@ -0,0 +1,280 @@
+package kvfs
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/docker/libkv/store"
+)
+
+// readCache is an LRU of values read from the kv store, keyed by backend key and tagged with the
+// LastIndex of the value.  An entry is served until a Watch on its key reports a change or ends.
+// With a directory, every cached value is also written to disk, so the last known values survive
+// restarts and can be served stale while the kv store is unreachable.  A nil *readCache caches
+// nothing.
+type readCache struct {
+	db    *Backend
+	stats *Stats
+	size  int
+	// "" if values are not persisted
+	dir        string
+	serveStale bool
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// set by close; nothing is cached anymore
+	closed bool
+}
+
+type cacheEntry struct {
+	Key   string `json:"key"`
+	Index uint64 `json:"index"`
+	Value []byte `json:"value"`
+
+	// false once the key changed or the watch on it ended; the value can still be served stale
+	valid bool
+	stop  chan struct{}
+}
+
+func newReadCache(db *Backend, size int, dir string, serveStale bool) (*readCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		pruneCacheDir(dir, size)
+	}
+	return &readCache{
+		db:         db,
+		stats:      db.Stats,
+		size:       size,
+		dir:        dir,
+		serveStale: serveStale,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}, nil
+}
+
+// get returns the cached value of the key, if it's known to be current.
+func (c *readCache) get(key string) (*store.KVPair, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, has := c.entries[key]
+	if !has || !el.Value.(*cacheEntry).valid {
+		c.stats.cacheMiss()
+		return nil, false
+	}
+	c.stats.cacheHit()
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).pair(), true
+}
+
+// stale returns the last known value of the key, from memory or disk, if serving stale values is
+// enabled.
+func (c *readCache) stale(key string) (*store.KVPair, bool) {
+	if c == nil || !c.serveStale {
+		return nil, false
+	}
+	c.mu.Lock()
+	el, has := c.entries[key]
+	c.mu.Unlock()
+
+	var e *cacheEntry
+	if has {
+		e = el.Value.(*cacheEntry)
+	} else if e = c.load(key); e == nil {
+		return nil, false
+	}
+	c.stats.staleRead()
+	return e.pair(), true
+}
+
+// put caches a value just read from the kv store and starts watching its key.
+func (c *readCache) put(key string, kv *store.KVPair) {
+	if c == nil {
+		return
+	}
+	e := &cacheEntry{
+		Key:   key,
+		Index: kv.LastIndex,
+		Value: append([]byte(nil), kv.Value...),
+		valid: true,
+		stop:  make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if el, has := c.entries[key]; has {
+		c.stopEntry(el.Value.(*cacheEntry))
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.size > 0 && c.lru.Len() > c.size {
+		// Evicted values are dropped from disk too, so it holds at most size values.
+		el := c.lru.Back()
+		evicted := el.Value.(*cacheEntry)
+		c.stopEntry(evicted)
+		c.lru.Remove(el)
+		delete(c.entries, evicted.Key)
+		if c.dir != "" {
+			os.Remove(c.file(evicted.Key))
+		}
+	}
+	c.mu.Unlock()
+
+	c.save(e)
+	go c.watch(e)
+}
+
+// invalidate stops serving the cached value of the key, e.g. after it was written through the mount.
+func (c *readCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, has := c.entries[key]; has {
+		c.stopEntry(el.Value.(*cacheEntry))
+	}
+}
+
+// flush drops every cached value, in memory and on disk.
+func (c *readCache) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, el := range c.entries {
+		c.stopEntry(el.Value.(*cacheEntry))
+	}
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	if c.dir == "" {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+// close stops the watches of the cached values, e.g. on unmount.  The values on disk are kept for
+// the next mount.
+func (c *readCache) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for _, el := range c.entries {
+		c.stopEntry(el.Value.(*cacheEntry))
+	}
+}
+
+// watch invalidates the entry when its key changes or the watch ends, e.g. because the connection
+// to the kv store was lost.
+func (c *readCache) watch(e *cacheEntry) {
+	ch, err := c.db.store.Watch(e.Key, e.stop)
+	if err == nil {
+		for kv := range ch {
+			// The current value is sent first.
+			if kv == nil || kv.LastIndex != e.Index {
+				break
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopEntry(e)
+}
+
+// stopEntry must be called with mu held.
+func (c *readCache) stopEntry(e *cacheEntry) {
+	if e.valid {
+		e.valid = false
+		close(e.stop)
+	}
+}
+
+// pruneCacheDir deletes the oldest values on disk beyond size, e.g. left by a mount with a larger
+// cache_size.
+func pruneCacheDir(dir string, size int) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) <= size {
+		return
+	}
+	infos := []os.FileInfo{}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	sort.Sort(byModTime(infos))
+	for i := 0; i < len(infos)-size; i++ {
+		os.Remove(filepath.Join(dir, infos[i].Name()))
+	}
+}
+
+type byModTime []os.FileInfo
+
+func (l byModTime) Len() int           { return len(l) }
+func (l byModTime) Less(i, j int) bool { return l[i].ModTime().Before(l[j].ModTime()) }
+func (l byModTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (c *readCache) file(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *readCache) save(e *cacheEntry) {
+	if c.dir == "" {
+		return
+	}
+	buff, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	tmp := c.file(e.Key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buff, 0600); err != nil {
+		return
+	}
+	os.Rename(tmp, c.file(e.Key))
+}
+
+func (c *readCache) load(key string) *cacheEntry {
+	if c.dir == "" {
+		return nil
+	}
+	buff, err := ioutil.ReadFile(c.file(key))
+	if err != nil {
+		return nil
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(buff, e); err != nil || e.Key != key {
+		return nil
+	}
+	return e
+}
+
+func (e *cacheEntry) pair() *store.KVPair {
+	return &store.KVPair{Key: e.Key, Value: e.Value, LastIndex: e.Index}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Set in the environment of the background process started by daemonize.
+const daemonEnv = "KVFS_DAEMON"
+
+// The background process reports to the foreground one on this file descriptor.
+const readyFd = 3
+
+// DaemonFlags are the flags of the commands that mount, for running under systemd or a supervisor.
+type DaemonFlags struct {
+	Daemon  bool   `flag:"daemon,Go in the background once mounted"`
+	PidFile string `flag:"pidfile,File to write the pid of the process serving the mount to"`
+	LogFile string `flag:"log,File to log to instead of stdout and stderr"`
+}
+
+// isDaemon returns true in the background process started by daemonize.
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// start goes in the background if asked to, or else logs to the log file.  It returns true in the
+// foreground process of a daemon, which has nothing left to do once it returns.
+func (this *DaemonFlags) start() (bool, error) {
+	if isDaemon() {
+		return false, nil
+	}
+	if this.Daemon {
+		return true, daemonize(this.LogFile)
+	}
+	if this.LogFile != "" {
+		f, err := openLog(this.LogFile)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		// Also the output of panics and of the libraries that write to the file descriptors.
+		for _, fd := range []int{1, 2} {
+			if err := syscall.Dup2(int(f.Fd()), fd); err != nil {
+				return false, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// ready writes the pidfile and tells systemd and the foreground process, if any, that the mount is
+// ready, or why it failed.
+func (this *DaemonFlags) ready(err error) {
+	if err == nil {
+		if this.PidFile != "" {
+			if err := ioutil.WriteFile(this.PidFile, []byte(fmt.Sprintln(os.Getpid())), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, "Cannot write pidfile. Err=", err)
+			}
+		}
+		sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	}
+	if !isDaemon() {
+		return
+	}
+	f := os.NewFile(readyFd, "ready")
+	if err != nil {
+		fmt.Fprint(f, err.Error())
+	} else {
+		fmt.Fprint(f, "READY")
+	}
+	f.Close()
+}
+
+// stop removes the pidfile and tells systemd the mount is going away.
+func (this *DaemonFlags) stop() {
+	sdNotify("STOPPING=1")
+	if this.PidFile != "" {
+		os.Remove(this.PidFile)
+	}
+}
+
+// daemonize runs the same command again in the background, in a new session and with its output
+// going to the log file, and waits until it calls ready.  It returns the error the background
+// process failed with, if any.
+func daemonize(logFile string) error {
+	exe := "/proc/self/exe"
+	if _, err := os.Stat(exe); err != nil {
+		if exe, err = exec.LookPath(os.Args[0]); err != nil {
+			return err
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	// The name it was run by matters, e.g. mount.kvfs
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if logFile != "" {
+		f, err := openLog(logFile)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		defer f.Close()
+		cmd.Stdout, cmd.Stderr = f, f
+	}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return err
+	}
+	w.Close()
+
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch string(msg) {
+	case "READY":
+		return nil
+	case "":
+		return fmt.Errorf("Exited before the mount was ready.")
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func openLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// sdNotify sends the state to systemd if it's listening, like sd_notify(3).
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot notify systemd. Err=", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+func init() {
+	config := &struct {
+		kvfs.Config
+
+		Url  string `flag:"url,Url to backend"`
+		Path string `flag:"path,Subtree below the root to check"`
+		Fix  bool   `flag:"fix,Fix the problems that can be fixed; without it, only report what would be done"`
+		Json bool   `flag:"json,Print the problems as json"`
+	}{
+		Config: defaultConfig(),
+	}
+
+	command.RegisterFunc("fsck", config,
+		func(a []string, w io.Writer) error {
+			url := config.Url
+			if url == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No url specified")
+				}
+				url = a[0]
+			}
+			backend, err := kvfs.NewBackend(url, &config.Config)
+			if err != nil {
+				return err
+			}
+			path := strings.Split(strings.Trim(config.Path, "/"), "/")
+			if config.Path == "" || config.Path == "/" {
+				path = []string{}
+			}
+			problems, err := backend.Fsck(path, config.Fix)
+			if err != nil {
+				return err
+			}
+
+			if config.Json {
+				enc := json.NewEncoder(w)
+				return enc.Encode(problems)
+			}
+			tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "PATH\tPROBLEM\tDETAIL\tFIX")
+			failed := 0
+			for _, problem := range problems {
+				fix := problem.Fix
+				switch {
+				case fix == "":
+					fix = "-"
+				case problem.Error != "":
+					fix = "failed: " + problem.Error
+					failed++
+				case problem.Fixed:
+					fix = "fixed: " + fix
+				case config.Fix:
+					fix = "kept"
+				default:
+					fix = "would " + fix
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", problem.Path, problem.Kind, problem.Detail, fix)
+			}
+			tw.Flush()
+			if failed > 0 {
+				return fmt.Errorf("%d problems could not be fixed", failed)
+			}
+			return nil
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Check the tree for missing and orphan directory markers, keys that are both a value and")
+			fmt.Fprintln(w, "a directory, names that can't be file names, and empty etcd records.  Without -fix, only")
+			fmt.Fprintln(w, "reports what would be fixed.")
+			fmt.Fprintln(w, "Usage: kvfs fsck <flags> <url>")
+		})
+}
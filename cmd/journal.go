@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"time"
+)
+
+func init() {
+	config := &struct {
+		Dir  string `flag:"dir,Journal directory, as given to mount -journal"`
+		Json bool   `flag:"json,Print the status as json"`
+	}{}
+
+	command.RegisterFunc("journal", config,
+		func(a []string, w io.Writer) error {
+			dir := config.Dir
+			if dir == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No journal directory specified.")
+				} else {
+					dir = a[0]
+				}
+			}
+
+			status, err := kvfs.ReadJournalStatus(dir)
+			if err != nil {
+				return err
+			}
+			if config.Json {
+				buff, err := json.MarshalIndent(status, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(w, string(buff))
+				return nil
+			}
+
+			fmt.Fprintf(w, "%d pending\n", len(status.Pending))
+			for _, e := range status.Pending {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%d bytes\t%s %d\n", e.Seq, e.Time.Format(time.RFC3339), e.Key, e.Size, e.Base, e.Index)
+			}
+			fmt.Fprintf(w, "%d conflicts\n", len(status.Conflicts))
+			for _, c := range status.Conflicts {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%d bytes\t%s %d current_index=%d\n", c.Seq, c.Time.Format(time.RFC3339), c.Key, c.Size, c.Base, c.Index, c.CurrentIndex)
+			}
+			return nil
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Show the writes pending in a write-back journal and the ones that conflicted on replay.")
+			fmt.Fprintln(w, "Values of conflicting writes are kept in <dir>/conflicts.")
+			fmt.Fprintln(w, "Usage: kvfs journal <flags> | <dir>")
+		})
+}
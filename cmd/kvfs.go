@@ -9,11 +9,26 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
-func main() {
+// Signals from the kernel.  Commands that block read from this to know when to stop.
+var fromKernel = make(chan os.Signal, 1)
+
+// Number of previous values kept by revert when -history is not set.
+const defaultHistory = 10
+
+// Defaults for the backend flags shared by the commands.
+func defaultConfig() kvfs.Config {
+	return kvfs.Config{
+		Retries:          3,
+		RetryWait:        100 * time.Millisecond,
+		BreakerThreshold: 5,
+		BreakerCooldown:  10 * time.Second,
+	}
+}
 
-	fromKernel := make(chan os.Signal)
+func main() {
 
 	// kill -9 is SIGKILL and is uncatchable.
 	signal.Notify(fromKernel, syscall.SIGHUP)  // 1
@@ -24,50 +39,89 @@ func main() {
 
 	config := &struct {
 		kvfs.Config
+		DaemonFlags
 
-		MountPath string `flag:"m,Mount path"`
-		Url       string `flag:"url,Url to backend"`
-	}{}
+		MountPath  string `flag:"m,Mount path"`
+		Url        string `flag:"url,Url to backend"`
+		MountsFile string `flag:"config,Yaml file of the mounts to manage; reloaded on SIGHUP"`
+	}{
+		Config: defaultConfig(),
+	}
 
 	command.RegisterFunc("mount", config,
 		func(a []string, w io.Writer) error {
-			url := config.Url
-			if url == "" {
-				if len(a) < 1 {
-					return fmt.Errorf("No url specified")
-				} else {
-					url = a[0]
-				}
+			if done, err := config.DaemonFlags.start(); done || err != nil {
+				return err
+			}
+			if config.MountsFile != "" {
+				return mountAll(config.MountsFile, config.Config, &config.DaemonFlags, os.Stdout)
+			}
+			urls := []string{}
+			if config.Url != "" {
+				urls = append(urls, config.Url)
 			}
 			mountPath := config.MountPath
 			if mountPath == "" {
-				if len(a) < 2 {
+				if len(a) < 1 {
 					return fmt.Errorf("No mount point specified.")
-				} else {
-					mountPath = a[1]
 				}
+				mountPath, a = a[len(a)-1], a[:len(a)-1]
+			}
+			// Any other arguments are the urls of the layers, top first.
+			urls = append(urls, a...)
+			if len(urls) == 0 {
+				return fmt.Errorf("No url specified")
 			}
 
-			closer, err := kvfs.Mount(url, mountPath, &config.Config)
+			closer, err := kvfs.MountUnion(urls, mountPath, &config.Config)
+			config.DaemonFlags.ready(err)
 			if err != nil {
 				return err
 			}
-
-			for range fromKernel {
-				fmt.Println("Unmounting", mountPath)
-				if err := kvfs.Unmount(mountPath); err == nil {
-					return nil
-				} else {
-					fmt.Println("Cannot unmount. Err=", err)
-				}
-			}
-			return closer.Close()
+			defer config.DaemonFlags.stop()
+			return serve(mountPath, closer)
 		},
 		func(w io.Writer) {
 			fmt.Fprintln(w, "Mount backend by url to local file system path.")
-			fmt.Fprintln(w, "Usage: kvfs mount <flags> | <url> <mountpoint>")
+			fmt.Fprintln(w, "With several urls, mount their union: the first url is the top layer, which is written to.")
+			fmt.Fprintln(w, "With -config, manage the mounts listed in the file, with the flags as defaults.")
+			fmt.Fprintln(w, "With -daemon, go in the background once mounted; systemd is notified when the mount is ready.")
+			fmt.Fprintln(w, "Usage: kvfs mount <flags> | <url> [<lower url>...] <mountpoint> | -config <mounts.yaml>")
 		})
 
+	if isMountHelper(os.Args) {
+		if err := mountHelper(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "mount.kvfs:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	runtime.Main()
 
 }
+
+// serve blocks until the kernel asks to stop, then unmounts, or until it's unmounted, e.g. by
+// kvfs unmount.
+func serve(mountPath string, closer io.Closer) error {
+	var done <-chan struct{}
+	if d, ok := closer.(interface {
+		Done() <-chan struct{}
+	}); ok {
+		done = d.Done()
+	}
+	for {
+		select {
+		case <-fromKernel:
+			fmt.Println("Unmounting", mountPath)
+			if err := kvfs.Unmount(mountPath); err == nil {
+				return nil
+			} else {
+				fmt.Println("Cannot unmount. Err=", err)
+			}
+		case <-done:
+			fmt.Println("Unmounted", mountPath)
+			return closer.Close()
+		}
+	}
+}
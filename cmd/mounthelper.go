@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/kvfs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How long _netdev mounts wait for the kv store by default.
+const defaultNetdevTimeout = time.Minute
+
+// isMountHelper returns true when run by mount(8), as mount.kvfs or mount.fuse.kvfs for
+// -t kvfs and -t fuse.kvfs, or as kvfs <url> <mountpoint> by mount.fuse.
+func isMountHelper(args []string) bool {
+	if strings.HasPrefix(filepath.Base(args[0]), "mount.") {
+		return true
+	}
+	return len(args) > 2 && strings.Contains(args[1], "://")
+}
+
+// Options that are for mount(8) or don't apply to kvfs.
+var ignoredOptions = map[string]bool{
+	"defaults": true, "rw": true, "auto": true, "noauto": true, "user": true, "nouser": true,
+	"users": true, "owner": true, "nofail": true, "dev": true, "nodev": true, "suid": true,
+	"nosuid": true, "exec": true, "noexec": true, "async": true, "sync": true, "atime": true,
+	"noatime": true, "relatime": true, "comment": true,
+}
+
+// helperArgs are the arguments of a mount helper.
+type helperArgs struct {
+	url, mountPath string
+	config         kvfs.Config
+	daemon         DaemonFlags
+	// wait until the kv store can be reached, for at most timeout
+	netdev  bool
+	timeout time.Duration
+	// -f: do everything but mount
+	fake bool
+}
+
+// parseHelperArgs parses the arguments of mountHelper.
+func parseHelperArgs(args []string) (*helperArgs, error) {
+	h := &helperArgs{
+		config:  defaultConfig(),
+		daemon:  DaemonFlags{Daemon: true},
+		timeout: defaultNetdevTimeout,
+	}
+	options := []string{}
+	sloppy := false
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-o" && i+1 < len(args):
+			i++
+			options = append(options, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(a, "-o"):
+			options = append(options, strings.Split(a[2:], ",")...)
+		case a == "-s":
+			sloppy = true
+		case a == "-f":
+			h.fake = true
+		case a == "-n" || a == "-v":
+		case h.url == "":
+			h.url = a
+		case h.mountPath == "":
+			h.mountPath = a
+		default:
+			return nil, fmt.Errorf("Unexpected argument %s", a)
+		}
+	}
+	if h.url == "" || h.mountPath == "" {
+		return nil, fmt.Errorf("Usage: mount.kvfs <url> <mountpoint> [-o options]")
+	}
+
+	for _, o := range options {
+		name, value := o, ""
+		if i := strings.Index(o, "="); i >= 0 {
+			name, value = o[:i], o[i+1:]
+		}
+		switch {
+		case name == "" || ignoredOptions[name] || strings.HasPrefix(name, "x-"):
+		case name == "_netdev":
+			h.netdev = true
+		case name == "netdev_timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("Bad value of %s: %v", name, err)
+			}
+			h.timeout = d
+		case name == "foreground":
+			h.daemon.Daemon = false
+		case name == "pidfile":
+			h.daemon.PidFile = value
+		case name == "log":
+			h.daemon.LogFile = value
+		case name == "ro":
+			h.config.ReadOnly = true
+		default:
+			if err := h.config.Set(name, value); err != nil && !sloppy {
+				return nil, err
+			}
+		}
+	}
+	return h, nil
+}
+
+// mountHelper mounts with the calling convention of mount(8) helpers:
+//
+//	mount.kvfs <url> <mountpoint> [-sfnv] [-o opt1,opt2=value,...]
+//
+// Options are the flags of kvfs mount, e.g. cache_size=1000 or pidfile=/run/kvfs.pid, plus _netdev
+// to wait until the kv store can be reached (for at most netdev_timeout) and foreground to not go
+// in the background.
+func mountHelper(args []string) error {
+	h, err := parseHelperArgs(args)
+	if err != nil || h.fake {
+		return err
+	}
+	daemon := &h.daemon
+	if done, err := daemon.start(); done || err != nil {
+		return err
+	}
+
+	if h.netdev {
+		if err := kvfs.WaitReachable(h.url, &h.config, h.timeout); err != nil {
+			err = fmt.Errorf("%s can't be reached: %v", h.url, err)
+			daemon.ready(err)
+			return err
+		}
+	}
+	closer, err := kvfs.Mount(h.url, h.mountPath, &h.config)
+	daemon.ready(err)
+	if err != nil {
+		return err
+	}
+	defer daemon.stop()
+	return serve(h.mountPath, closer)
+}
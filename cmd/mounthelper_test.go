@@ -0,0 +1,106 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMountHelper(t *testing.T) { TestingT(t) }
+
+type TestSuiteMountHelper struct{}
+
+var _ = Suite(&TestSuiteMountHelper{})
+
+func (suite *TestSuiteMountHelper) TestParseHelperArgs(c *C) {
+	parsed := func(fn func(h *helperArgs)) *helperArgs {
+		h := &helperArgs{
+			url:       "zk://localhost:2181/app",
+			mountPath: "/mnt/app",
+			config:    defaultConfig(),
+			daemon:    DaemonFlags{Daemon: true},
+			timeout:   defaultNetdevTimeout,
+		}
+		fn(h)
+		return h
+	}
+	for _, t := range []struct {
+		args string
+		want *helperArgs
+		err  string
+	}{
+		{
+			args: "zk://localhost:2181/app /mnt/app",
+			want: parsed(func(h *helperArgs) {}),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -o cache_size=1000,cas",
+			want: parsed(func(h *helperArgs) {
+				h.config.CacheSize = 1000
+				h.config.CAS = true
+			}),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -ocache_size=10 -o ro",
+			want: parsed(func(h *helperArgs) {
+				h.config.CacheSize = 10
+				h.config.ReadOnly = true
+			}),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -n -v -o defaults,noauto,x-systemd.automount,comment=kvfs",
+			want: parsed(func(h *helperArgs) {}),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -o _netdev,netdev_timeout=5s",
+			want: parsed(func(h *helperArgs) {
+				h.netdev = true
+				h.timeout = 5 * time.Second
+			}),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -o foreground,pidfile=/run/kvfs.pid,log=/var/log/kvfs.log",
+			want: parsed(func(h *helperArgs) {
+				h.daemon = DaemonFlags{PidFile: "/run/kvfs.pid", LogFile: "/var/log/kvfs.log"}
+			}),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -f",
+			want: parsed(func(h *helperArgs) { h.fake = true }),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -s -o nope,cache_size=lots",
+			want: parsed(func(h *helperArgs) {}),
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -o nope",
+			err:  "Unknown option nope",
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app -o netdev_timeout=5",
+			err:  "Bad value of netdev_timeout: .*",
+		},
+		{
+			args: "zk://localhost:2181/app /mnt/app /mnt/other",
+			err:  "Unexpected argument /mnt/other",
+		},
+		{
+			args: "zk://localhost:2181/app",
+			err:  "Usage: .*",
+		},
+		{
+			// no options
+			args: "zk://localhost:2181/app /mnt/app -o",
+			want: parsed(func(h *helperArgs) {}),
+		},
+	} {
+		h, err := parseHelperArgs(strings.Fields(t.args))
+		if t.err != "" {
+			c.Assert(err, ErrorMatches, t.err, Commentf(t.args))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf(t.args))
+		c.Assert(h, DeepEquals, t.want, Commentf(t.args))
+	}
+}
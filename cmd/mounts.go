@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/kvfs"
+	"io"
+	"syscall"
+	"text/tabwriter"
+)
+
+// mountAll manages the mounts of a mounts file until it's told to stop.  SIGHUP reads the file
+// again and mounts, unmounts or remounts what changed.
+// The process is ready once the mounts have been tried, even if some failed.
+func mountAll(path string, defaults kvfs.Config, daemon *DaemonFlags, w io.Writer) error {
+	mounts, err := kvfs.ReadMountsFile(path)
+	if err != nil {
+		daemon.ready(err)
+		return err
+	}
+	mounter := kvfs.NewMounter(defaults)
+	if err := mounter.Apply(mounts.Mounts); err != nil {
+		fmt.Fprintln(w, "Some mounts failed. Err=", err)
+	}
+	printMounts(mounter, w)
+	daemon.ready(nil)
+	defer daemon.stop()
+
+	for sig := range fromKernel {
+		if sig == syscall.SIGHUP {
+			fmt.Fprintln(w, "Reloading", path)
+			mounts, err := kvfs.ReadMountsFile(path)
+			if err != nil {
+				fmt.Fprintln(w, "Cannot reload. Err=", err)
+				continue
+			}
+			if err := mounter.Apply(mounts.Mounts); err != nil {
+				fmt.Fprintln(w, "Some mounts failed. Err=", err)
+			}
+			printMounts(mounter, w)
+			continue
+		}
+		fmt.Fprintln(w, "Unmounting all")
+		if err := mounter.UnmountAll(); err == nil {
+			return nil
+		} else {
+			fmt.Fprintln(w, "Cannot unmount. Err=", err)
+			printMounts(mounter, w)
+		}
+	}
+	return nil
+}
+
+func printMounts(mounter *kvfs.Mounter, w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MOUNTPOINT\tURL\tSTATE\tSINCE")
+	for _, s := range mounter.Status() {
+		state := "mounted"
+		if !s.Mounted {
+			state = "failed: " + s.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Mountpoint, s.Url, state, s.Since.Format("2006-01-02T15:04:05"))
+	}
+	tw.Flush()
+}
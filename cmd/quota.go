@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"strings"
+)
+
+func init() {
+	config := &struct {
+		kvfs.Config
+
+		Url         string `flag:"url,Url to backend"`
+		Path        string `flag:"path,Directory below the url"`
+		MaxBytes    uint64 `flag:"max_bytes,Max total size of the values below the directory"`
+		MaxEntries  uint64 `flag:"max_entries,Max number of files and directories below the directory"`
+		MaxFileSize uint64 `flag:"max_file_size,Max size of a value below the directory"`
+		Clear       bool   `flag:"clear,Remove the quota"`
+	}{
+		Config: defaultConfig(),
+	}
+
+	command.RegisterFunc("quota", config,
+		func(a []string, w io.Writer) error {
+			url := config.Url
+			if url == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No url specified")
+				} else {
+					url = a[0]
+				}
+			}
+
+			backend, err := kvfs.NewBackend(url, &config.Config)
+			if err != nil {
+				return err
+			}
+			path := []string{}
+			if p := strings.Trim(config.Path, "/"); p != "" {
+				path = strings.Split(p, "/")
+			}
+
+			switch {
+			case config.Clear:
+				if err := backend.DeleteQuota(path); err != nil {
+					return err
+				}
+			case config.MaxBytes > 0 || config.MaxEntries > 0 || config.MaxFileSize > 0:
+				err := backend.SetQuota(path, &kvfs.Quota{
+					MaxBytes:    config.MaxBytes,
+					MaxEntries:  config.MaxEntries,
+					MaxFileSize: config.MaxFileSize,
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			quota, err := backend.Quota(path)
+			if err != nil {
+				return err
+			}
+			usage, err := backend.Usage(path)
+			if err != nil {
+				return err
+			}
+			limit := func(v uint64) string {
+				if v == 0 {
+					return "unlimited"
+				}
+				return fmt.Sprint(v)
+			}
+			if quota == nil {
+				quota = &kvfs.Quota{}
+			}
+			fmt.Fprintf(w, "bytes\t%d / %s\n", usage.Bytes, limit(quota.MaxBytes))
+			fmt.Fprintf(w, "entries\t%d / %s\n", usage.Keys+usage.Dirs, limit(quota.MaxEntries))
+			fmt.Fprintf(w, "file size\t%s\n", limit(quota.MaxFileSize))
+			return nil
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Show or set the quota of a directory.  Quotas are kept in the kv store and enforced by every mount.")
+			fmt.Fprintln(w, "Usage: kvfs quota <flags> | <url> -path /team -max_bytes 10485760 -max_entries 1000")
+		})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	config := &struct {
+		kvfs.Config
+
+		Url string `flag:"url,Url to backend"`
+	}{
+		Config: defaultConfig(),
+	}
+
+	command.RegisterFunc("revert", config,
+		func(a []string, w io.Writer) error {
+			url := config.Url
+			if url == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No url specified")
+				}
+				url, a = a[0], a[1:]
+			}
+			if len(a) < 1 {
+				return fmt.Errorf("No path specified.")
+			}
+			path := strings.Split(strings.Trim(a[0], "/"), "/")
+
+			backend, err := kvfs.NewBackend(url, &config.Config)
+			if err != nil {
+				return err
+			}
+
+			if len(a) < 2 {
+				records, err := backend.History(path)
+				if err != nil {
+					return err
+				}
+				for _, r := range records {
+					fmt.Fprintf(w, "%d\t%s\tuid=%d\t%d bytes\n", r.Index, r.Time.Format(time.RFC3339), r.Uid, len(r.Value))
+				}
+				return nil
+			}
+
+			index, err := strconv.ParseUint(a[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			limit := config.History
+			if limit == 0 {
+				limit = defaultHistory
+			}
+			return backend.Revert(path, index, uint32(os.Getuid()), limit)
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Write back a previous value of a key from the history kept by mounts with -history.")
+			fmt.Fprintln(w, "Without an index, list the previous values.")
+			fmt.Fprintln(w, "Usage: kvfs revert <flags> | <url> <path> [<index>]")
+		})
+}
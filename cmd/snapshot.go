@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"strings"
+	"time"
+)
+
+func init() {
+	config := &struct {
+		kvfs.Config
+
+		Url    string `flag:"url,Url to backend"`
+		Path   string `flag:"path,Subtree below the root to snapshot"`
+		DryRun bool   `flag:"dry_run,Print the changes of a restore without making them"`
+	}{
+		Config: defaultConfig(),
+	}
+
+	command.RegisterFunc("snapshot", config,
+		func(a []string, w io.Writer) error {
+			url := config.Url
+			if url == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No url specified")
+				}
+				url, a = a[0], a[1:]
+			}
+			if len(a) < 1 {
+				return fmt.Errorf("No operation specified.")
+			}
+			op, a := a[0], a[1:]
+			if op != "list" && len(a) < 1 {
+				return fmt.Errorf("No snapshot name specified.")
+			}
+
+			backend, err := kvfs.NewBackend(url, &config.Config)
+			if err != nil {
+				return err
+			}
+
+			switch op {
+			case "create":
+				path := strings.Split(strings.Trim(config.Path, "/"), "/")
+				if config.Path == "" || config.Path == "/" {
+					path = []string{}
+				}
+				m, err := backend.CreateSnapshot(a[0], path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d keys\t%d dirs\t%d bytes\n", m.Name, m.Path, m.Keys, m.Dirs, m.Bytes)
+			case "list":
+				list, err := backend.Snapshots()
+				if err != nil {
+					return err
+				}
+				for _, m := range list {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d keys\t%d bytes\n", m.Name, m.Path, m.Created.Format(time.RFC3339), m.Keys, m.Bytes)
+				}
+			case "restore":
+				changes, err := backend.RestoreSnapshot(a[0], config.DryRun)
+				for _, c := range changes {
+					kind := "key"
+					if c.Dir {
+						kind = "dir"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", c.Op, kind, c.Key)
+				}
+				return err
+			case "delete":
+				return backend.DeleteSnapshot(a[0])
+			default:
+				return fmt.Errorf("Unknown operation %q.", op)
+			}
+			return nil
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Create, list, restore or delete snapshots of a subtree of the kv store.")
+			fmt.Fprintln(w, "A restore writes only the keys that differ, and stops if one changes while it runs.")
+			fmt.Fprintln(w, "Usage: kvfs snapshot <flags> | <url> create|list|restore|delete [<name>]")
+		})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	config := &struct {
+		Json bool `flag:"json,Print the mounts as json"`
+	}{}
+
+	command.RegisterFunc("status", config,
+		func(a []string, w io.Writer) error {
+			infos, err := kvfs.ControlMounts()
+			if err != nil {
+				return err
+			}
+			// Mounts listed by the kernel but not by a process are shown with what the kernel knows.
+			byMountpoint := map[string]*kvfs.MountInfo{}
+			for _, info := range infos {
+				byMountpoint[info.Mountpoint] = info
+			}
+			system, err := kvfs.SystemMounts()
+			if err != nil {
+				return err
+			}
+			for _, m := range system {
+				mountpoint := m.Mountpoint
+				if abs, err := filepath.Abs(mountpoint); err == nil {
+					mountpoint = abs
+				}
+				if _, has := byMountpoint[mountpoint]; !has {
+					info := &kvfs.MountInfo{Mountpoint: mountpoint, Backend: m.Source, Status: "unknown"}
+					byMountpoint[mountpoint] = info
+					infos = append(infos, info)
+				}
+			}
+
+			if config.Json {
+				buff, err := json.MarshalIndent(infos, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(w, string(buff))
+				return nil
+			}
+			tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "MOUNTPOINT\tBACKEND\tPID\tUPTIME\tSTATUS\tPENDING")
+			for _, info := range infos {
+				pid, uptime := "-", "-"
+				if info.Pid != 0 {
+					pid = strconv.Itoa(info.Pid)
+					uptime = (time.Since(info.Started) / time.Second * time.Second).String()
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", info.Mountpoint, info.Backend, pid, uptime, info.Status, info.Pending)
+			}
+			return tw.Flush()
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "List the kvfs mounts of this host with their backend, pid, uptime and status.")
+			fmt.Fprintln(w, "Usage: kvfs status <flags>")
+		})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"time"
+)
+
+func init() {
+	config := &struct {
+		kvfs.Config
+
+		Url string `flag:"url,Url to backend"`
+	}{
+		Config: defaultConfig(),
+	}
+
+	command.RegisterFunc("trash", config,
+		func(a []string, w io.Writer) error {
+			url := config.Url
+			if url == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No url specified")
+				}
+				url, a = a[0], a[1:]
+			}
+			op := "list"
+			if len(a) > 0 {
+				op, a = a[0], a[1:]
+			}
+			if (op == "restore" || op == "delete") && len(a) < 1 {
+				return fmt.Errorf("No trash entry specified.")
+			}
+
+			backend, err := kvfs.NewBackend(url, &config.Config)
+			if err != nil {
+				return err
+			}
+
+			switch op {
+			case "list":
+				entries, err := backend.TrashEntries()
+				if err != nil {
+					return err
+				}
+				for _, e := range entries {
+					fmt.Fprintf(w, "%s\t%s\t%s\tuid=%d\t%d keys\t%d bytes\n", e.Id, e.Path, e.Time.Format(time.RFC3339), e.Uid, e.Keys, e.Bytes)
+				}
+			case "restore":
+				e, err := backend.RestoreTrash(a[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(w, "Restored", e.Path)
+			case "delete":
+				return backend.DeleteTrash(a[0])
+			case "purge":
+				purged, err := backend.PurgeTrash(config.TrashRetention, config.TrashMaxBytes)
+				for _, e := range purged {
+					fmt.Fprintln(w, "Purged", e.Id, e.Path)
+				}
+				return err
+			default:
+				return fmt.Errorf("Unknown operation %q.", op)
+			}
+			return nil
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "List, restore or delete the files and directories removed from mounts with -trash.")
+			fmt.Fprintln(w, "Purge deletes the entries older than -trash_retention and the oldest ones above -trash_max_bytes.")
+			fmt.Fprintln(w, "Usage: kvfs trash <flags> | <url> list|restore <id>|delete <id>|purge")
+		})
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The commands that work on the tree without a mount.  They go through the same DirLike as the
+// mount, so directory markers and the other reserved entries are handled and hidden the same way.
+// Paths with reserved names are refused by openPath.
+
+// TreeFlags are the flags of the commands that work on the tree without a mount.
+type TreeFlags struct {
+	Root string `flag:"root,Path of the url that is mounted, whose trash is used; by default the closest one with a ~kvfs~ directory"`
+}
+
+// openPath returns a backend at the root a mount would use, and the path of the url below it.
+func (this *TreeFlags) openPath(url string, config *kvfs.Config) (*kvfs.Backend, []string, error) {
+	return kvfs.OpenPath(url, this.Root, config)
+}
+
+// parentOf returns the directory of the path and the name of the entry in it.
+func parentOf(backend *kvfs.Backend, path []string) (kvfs.StrictDirLike, string, error) {
+	if len(path) == 0 {
+		return nil, "", fmt.Errorf("No path specified.")
+	}
+	return backend.Context(nil).StrictDir(path[:len(path)-1]), path[len(path)-1], nil
+}
+
+// isDir returns true if the path is the root or a directory.
+func isDir(backend *kvfs.Backend, path []string) (bool, error) {
+	if len(path) == 0 {
+		return true, nil
+	}
+	parent, name, err := parentOf(backend, path)
+	if err != nil {
+		return false, err
+	}
+	stat, err := parent.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	return stat.Dir, nil
+}
+
+func urlArg(a []string) (string, error) {
+	if len(a) < 1 {
+		return "", fmt.Errorf("No url specified")
+	}
+	return a[0], nil
+}
+
+func init() {
+	lsConfig := &struct {
+		kvfs.Config
+		TreeFlags
+		Long bool `flag:"l,Show the size and version of files"`
+	}{
+		Config: defaultConfig(),
+	}
+	command.RegisterFunc("ls", lsConfig,
+		func(a []string, w io.Writer) error {
+			url, err := urlArg(a)
+			if err != nil {
+				return err
+			}
+			backend, path, err := lsConfig.openPath(url, &lsConfig.Config)
+			if err != nil {
+				return err
+			}
+			if dir, err := isDir(backend, path); err != nil {
+				return err
+			} else if !dir {
+				fmt.Fprintln(w, path[len(path)-1])
+				return nil
+			}
+			d := backend.Context(nil).StrictDir(path)
+			for entry := range d.Cursor() {
+				if entry.Err != nil {
+					return entry.Err
+				}
+				switch {
+				case entry.Dir:
+					fmt.Fprintln(w, entry.Key+"/")
+				case lsConfig.Long:
+					stat, err := d.Stat(entry.Key)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(w, "%s\t%d\t%d\n", entry.Key, stat.Size, stat.LastIndex)
+				default:
+					fmt.Fprintln(w, entry.Key)
+				}
+			}
+			return nil
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "List a directory of the kv store. Directories end with /.")
+			fmt.Fprintln(w, "Usage: kvfs ls <flags> <url>/<path>")
+		})
+
+	catConfig := &struct {
+		kvfs.Config
+		TreeFlags
+	}{
+		Config: defaultConfig(),
+	}
+	command.RegisterFunc("cat", catConfig,
+		func(a []string, w io.Writer) error {
+			url, err := urlArg(a)
+			if err != nil {
+				return err
+			}
+			backend, path, err := catConfig.openPath(url, &catConfig.Config)
+			if err != nil {
+				return err
+			}
+			parent, name, err := parentOf(backend, path)
+			if err != nil {
+				return err
+			}
+			v, err := parent.Get(name)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(v)
+			return err
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Print the value of a key.")
+			fmt.Fprintln(w, "Usage: kvfs cat <flags> <url>/<path>")
+		})
+
+	putConfig := &struct {
+		kvfs.Config
+		TreeFlags
+		Parents bool `flag:"p,Create the directories of the path that don't exist"`
+	}{
+		Config: defaultConfig(),
+	}
+	command.RegisterFunc("put", putConfig,
+		func(a []string, w io.Writer) error {
+			url, err := urlArg(a)
+			if err != nil {
+				return err
+			}
+			backend, path, err := putConfig.openPath(url, &putConfig.Config)
+			if err != nil {
+				return err
+			}
+			parent, name, err := parentOf(backend, path)
+			if err != nil {
+				return err
+			}
+			var value []byte
+			if len(a) > 1 {
+				value = []byte(a[1])
+			} else if value, err = ioutil.ReadAll(os.Stdin); err != nil {
+				return err
+			}
+			if putConfig.Parents {
+				if err := backend.MkdirAll(path[:len(path)-1]); err != nil {
+					return err
+				}
+			} else if dir, err := isDir(backend, path[:len(path)-1]); err != nil {
+				return err
+			} else if !dir {
+				return &kvfs.ErrNotDir{Key: strings.Join(path[:len(path)-1], "/")}
+			}
+			size := 0
+			if stat, err := parent.Stat(name); err == nil && stat.Dir {
+				return fmt.Errorf("%s is a directory", name)
+			} else if err == nil {
+				size = stat.Size
+			} else if err := backend.CheckEntries(path[:len(path)-1]); err != nil {
+				return err
+			}
+			delta := int64(len(value) - size)
+			if err := backend.CheckWrite(path[:len(path)-1], uint64(len(value)), delta); err != nil {
+				return err
+			}
+			return parent.Put(name, value)
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Write the value of a key, from the argument or stdin.")
+			fmt.Fprintln(w, "Usage: kvfs put <flags> <url>/<path> [<value>]")
+		})
+
+	rmConfig := &struct {
+		kvfs.Config
+		TreeFlags
+		Recursive bool `flag:"r,Remove directories and everything below them"`
+	}{
+		Config: defaultConfig(),
+	}
+	command.RegisterFunc("rm", rmConfig,
+		func(a []string, w io.Writer) error {
+			url, err := urlArg(a)
+			if err != nil {
+				return err
+			}
+			backend, path, err := rmConfig.openPath(url, &rmConfig.Config)
+			if err != nil {
+				return err
+			}
+			parent, name, err := parentOf(backend, path)
+			if err != nil {
+				return err
+			}
+			stat, err := parent.Stat(name)
+			if err != nil {
+				return err
+			}
+			if stat.Dir && !rmConfig.Recursive {
+				return fmt.Errorf("%s is a directory, use -r", name)
+			}
+			if rmConfig.Trash {
+				_, err := backend.Trash(path, uint32(os.Getuid()))
+				return err
+			}
+			if stat.Dir {
+				return parent.DeleteDir(name)
+			}
+			return parent.Delete(name)
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Remove a key, or a directory with -r. With -trash, move it to the trash instead.")
+			fmt.Fprintln(w, "Usage: kvfs rm <flags> <url>/<path>")
+		})
+
+	mkdirConfig := &struct {
+		kvfs.Config
+		TreeFlags
+		Parents bool `flag:"p,Create the directories of the path that don't exist"`
+	}{
+		Config: defaultConfig(),
+	}
+	command.RegisterFunc("mkdir", mkdirConfig,
+		func(a []string, w io.Writer) error {
+			url, err := urlArg(a)
+			if err != nil {
+				return err
+			}
+			backend, path, err := mkdirConfig.openPath(url, &mkdirConfig.Config)
+			if err != nil {
+				return err
+			}
+			parent, name, err := parentOf(backend, path)
+			if err != nil {
+				return err
+			}
+			if mkdirConfig.Parents {
+				return backend.MkdirAll(path)
+			}
+			if dir, err := isDir(backend, path[:len(path)-1]); err != nil {
+				return err
+			} else if !dir {
+				return &kvfs.ErrNotDir{Key: strings.Join(path[:len(path)-1], "/")}
+			}
+			if _, err := parent.Stat(name); err == nil {
+				return fmt.Errorf("%s exists", name)
+			}
+			if err := backend.CheckEntries(path[:len(path)-1]); err != nil {
+				return err
+			}
+			_, err = parent.CreateDir(name)
+			return err
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Create a directory.")
+			fmt.Fprintln(w, "Usage: kvfs mkdir <flags> <url>/<path>")
+		})
+
+	treeConfig := &struct {
+		kvfs.Config
+		TreeFlags
+	}{
+		Config: defaultConfig(),
+	}
+	command.RegisterFunc("tree", treeConfig,
+		func(a []string, w io.Writer) error {
+			url, err := urlArg(a)
+			if err != nil {
+				return err
+			}
+			backend, path, err := treeConfig.openPath(url, &treeConfig.Config)
+			if err != nil {
+				return err
+			}
+			var tree func(d kvfs.StrictDirLike, indent string) error
+			tree = func(d kvfs.StrictDirLike, indent string) error {
+				for entry := range d.Cursor() {
+					if entry.Err != nil {
+						return entry.Err
+					}
+					if !entry.Dir {
+						fmt.Fprintln(w, indent+entry.Key)
+						continue
+					}
+					fmt.Fprintln(w, indent+entry.Key+"/")
+					child, err := d.Dir(entry.Key)
+					if err != nil {
+						return err
+					}
+					if err := tree(child, indent+"  "); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			fmt.Fprintln(w, "/"+strings.Join(path, "/"))
+			return tree(backend.Context(nil).StrictDir(path), "  ")
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Print the tree below a directory.")
+			fmt.Fprintln(w, "Usage: kvfs tree <flags> <url>/<path>")
+		})
+
+	statConfig := &struct {
+		kvfs.Config
+		TreeFlags
+	}{
+		Config: defaultConfig(),
+	}
+	command.RegisterFunc("stat", statConfig,
+		func(a []string, w io.Writer) error {
+			url, err := urlArg(a)
+			if err != nil {
+				return err
+			}
+			backend, path, err := statConfig.openPath(url, &statConfig.Config)
+			if err != nil {
+				return err
+			}
+			dir, err := isDir(backend, path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, "path:", "/"+strings.Join(path, "/"))
+			if dir {
+				usage, err := backend.Usage(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(w, "type: directory")
+				fmt.Fprintln(w, "keys:", usage.Keys)
+				fmt.Fprintln(w, "dirs:", usage.Dirs)
+				fmt.Fprintln(w, "bytes:", usage.Bytes)
+				if quota, err := backend.Quota(path); err == nil && quota != nil {
+					fmt.Fprintf(w, "quota: max_bytes=%d max_entries=%d max_file_size=%d\n",
+						quota.MaxBytes, quota.MaxEntries, quota.MaxFileSize)
+				}
+				return nil
+			}
+			parent, name, err := parentOf(backend, path)
+			if err != nil {
+				return err
+			}
+			stat, err := parent.Stat(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, "type: file")
+			fmt.Fprintln(w, "size:", stat.Size)
+			fmt.Fprintln(w, "version:", stat.LastIndex)
+			return nil
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Describe a key or directory: size and version, or usage and quota.")
+			fmt.Fprintln(w, "Usage: kvfs stat <flags> <url>/<path>")
+		})
+}
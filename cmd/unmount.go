@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+)
+
+func init() {
+	config := &struct {
+		MountPath string `flag:"m,Mount path"`
+		Lazy      bool   `flag:"lazy,Detach the mount now and clean up once it's no longer busy"`
+		Force     bool   `flag:"force,Unmount even if the process serving the mount doesn't answer"`
+		NoFlush   bool   `flag:"no_flush,Don't ask the process serving the mount to write the write-back journal first"`
+	}{}
+
+	command.RegisterFunc("unmount", config,
+		func(a []string, w io.Writer) error {
+			mountPath := config.MountPath
+			if mountPath == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No mount point specified.")
+				}
+				mountPath = a[0]
+			}
+			if !config.NoFlush {
+				if err := kvfs.FlushMount(mountPath); err != nil {
+					if _, is := err.(*kvfs.ErrNotFound); !is && !config.Force {
+						return fmt.Errorf("Cannot flush %s, use -force to unmount anyway. Err= %v", mountPath, err)
+					}
+				}
+			}
+			return kvfs.UnmountWith(mountPath, config.Lazy, config.Force)
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Unmount a kvfs mount, once the process serving it has written its write-back journal.")
+			fmt.Fprintln(w, "Usage: kvfs unmount <flags> | <mountpoint>")
+		})
+}
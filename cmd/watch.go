@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/command"
+	"github.com/conductant/kvfs"
+	"io"
+	"strings"
+	"time"
+)
+
+func init() {
+	config := &struct {
+		kvfs.Config
+
+		Url       string        `flag:"url,Url to backend"`
+		Prefix    string        `flag:"prefix,Path below the url to watch"`
+		Exec      string        `flag:"exec,Command to run when keys change"`
+		Debounce  time.Duration `flag:"debounce,Wait for changes to settle for this long before running"`
+		Retries   int           `flag:"retries,Number of retries when the command fails"`
+		RetryWait time.Duration `flag:"retry_wait,Wait before the first retry; doubles after each retry"`
+	}{
+		Config:    defaultConfig(),
+		Debounce:  time.Second,
+		Retries:   3,
+		RetryWait: time.Second,
+	}
+
+	command.RegisterFunc("watch", config,
+		func(a []string, w io.Writer) error {
+			url := config.Url
+			if url == "" {
+				if len(a) < 1 {
+					return fmt.Errorf("No url specified")
+				} else {
+					url = a[0]
+				}
+			}
+			if config.Exec == "" {
+				return fmt.Errorf("No command specified.")
+			}
+
+			backend, err := kvfs.NewBackend(url, &config.Config)
+			if err != nil {
+				return err
+			}
+
+			stop := make(chan struct{})
+			go func() {
+				<-fromKernel
+				close(stop)
+			}()
+
+			return backend.Hook(strings.Split(strings.Trim(config.Prefix, "/"), "/"), &kvfs.HookConfig{
+				Command:   config.Exec,
+				Debounce:  config.Debounce,
+				Retries:   config.Retries,
+				RetryWait: config.RetryWait,
+				Stdout:    w,
+			}, stop)
+		},
+		func(w io.Writer) {
+			fmt.Fprintln(w, "Run a command when keys below a path change.")
+			fmt.Fprintln(w, "The changed keys are in the env as KVFS_CHANGED_KEYS and on stdin as '<op> <key>' lines.")
+			fmt.Fprintln(w, "Usage: kvfs watch <flags> | <url> -prefix /app -exec 'systemctl reload app'")
+		})
+}
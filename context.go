@@ -9,6 +9,7 @@ import (
 type Context interface {
 	context.Context
 	Dir([]string) DirLike
+	StrictDir([]string) StrictDirLike
 	Store() store.Store
 }
 
@@ -36,6 +37,14 @@ func (this *context_t) Store() store.Store {
 }
 
 func (this *context_t) Dir(path []string) DirLike {
+	return this.dir(path)
+}
+
+func (this *context_t) StrictDir(path []string) StrictDirLike {
+	return &strictDir{*this.dir(path)}
+}
+
+func (this *context_t) dir(path []string) *dir {
 	s := contextGetStore(this)
 	if s == nil {
 		panic(fmt.Errorf("assert-store-failed"))
@@ -0,0 +1,300 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Every process that serves mounts listens on a unix socket in SocketDir, named by its pid, so
+// kvfs status and kvfs unmount can find it.  A request and its reply are each a line of json.
+
+// MountInfo describes a mount served by a process.
+type MountInfo struct {
+	Mountpoint string    `json:"mountpoint"`
+	Backend    string    `json:"backend"`
+	Pid        int       `json:"pid"`
+	Started    time.Time `json:"started"`
+	// connected or degraded, like /.kvfs/status
+	Status string `json:"status"`
+	// journal entries not yet written to the kv store
+	Pending int `json:"pending,omitempty"`
+}
+
+// SystemMount is a kvfs mount listed by the kernel.
+type SystemMount struct {
+	// The url, as given to the kernel
+	Source     string
+	Mountpoint string
+}
+
+const (
+	controlStatus = "status"
+	controlFlush  = "flush"
+)
+
+type controlRequest struct {
+	Op         string `json:"op"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+}
+
+type controlReply struct {
+	Mounts []*MountInfo `json:"mounts,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// SocketDir is the directory of the control sockets: /run/kvfs for root, or for other users kvfs in
+// $XDG_RUNTIME_DIR, or else a directory of the user in the temp dir.
+func SocketDir() string {
+	if os.Geteuid() == 0 {
+		return "/run/kvfs"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "kvfs")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("kvfs-%d", os.Geteuid()))
+}
+
+// checkSocketDir refuses a socket directory that isn't owned by the user or is open to others, e.g.
+// made in the temp dir by another user to receive or fake the sockets.
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, is := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !is || int(stat.Uid) != os.Geteuid() || info.Mode().Perm() != 0700 {
+		return fmt.Errorf("Unsafe control socket directory %s: not a directory of uid %d with mode 0700", dir, os.Geteuid())
+	}
+	return nil
+}
+
+type controlMount struct {
+	fs      *FS
+	started time.Time
+}
+
+type controlServer struct {
+	mu     sync.Mutex
+	mounts map[string]*controlMount
+	// nil while the process serves no mounts
+	listener net.Listener
+}
+
+// The control server of this process.  It's started by the first mount and stopped when the last
+// one is unmounted.
+var control = &controlServer{mounts: map[string]*controlMount{}}
+
+func (this *controlServer) add(mountpoint string, f *FS) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.listener == nil {
+		this.listener = this.listen()
+	}
+	this.mounts[mountpoint] = &controlMount{fs: f, started: time.Now()}
+}
+
+func (this *controlServer) remove(mountpoint string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.mounts, mountpoint)
+	if len(this.mounts) == 0 && this.listener != nil {
+		// Closing also removes the socket file.
+		this.listener.Close()
+		this.listener = nil
+	}
+}
+
+// listen listens on the control socket of the process, or returns nil if it can't.
+func (this *controlServer) listen() net.Listener {
+	dir := SocketDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot create control socket. Err=", err)
+		return nil
+	}
+	if err := checkSocketDir(dir); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot create control socket. Err=", err)
+		return nil
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.sock", os.Getpid()))
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot create control socket. Err=", err)
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go this.serve(conn)
+		}
+	}()
+	return l
+}
+
+func (this *controlServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	req := &controlRequest{}
+	reply := &controlReply{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		return
+	}
+	switch req.Op {
+	case controlStatus:
+		reply.Mounts = this.status()
+	case controlFlush:
+		this.mu.Lock()
+		m, has := this.mounts[req.Mountpoint]
+		this.mu.Unlock()
+		if !has {
+			reply.Error = "not mounted: " + req.Mountpoint
+		} else if err := m.fs.flush(); err != nil {
+			reply.Error = err.Error()
+		}
+	default:
+		reply.Error = "unknown op: " + req.Op
+	}
+	json.NewEncoder(conn).Encode(reply)
+}
+
+func (this *controlServer) status() []*MountInfo {
+	this.mu.Lock()
+	mounts := map[string]*controlMount{}
+	for k, v := range this.mounts {
+		mounts[k] = v
+	}
+	this.mu.Unlock()
+
+	out := []*MountInfo{}
+	for mountpoint, m := range mounts {
+		info := &MountInfo{
+			Mountpoint: mountpoint,
+			Backend:    m.fs.db.String(),
+			Pid:        os.Getpid(),
+			Started:    m.started,
+			Status:     strings.SplitN(m.fs.status(), "\n", 2)[0],
+		}
+		if m.fs.journal != nil {
+			info.Pending = m.fs.journal.Len()
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// flush writes what the mount holds back, i.e. the write-back journal, to the kv store.
+func (f *FS) flush() error {
+	if f.journal == nil {
+		return nil
+	}
+	return f.journal.Replay()
+}
+
+// callControl sends a request to the control socket at path.
+func callControl(path string, req *controlRequest) (*controlReply, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	reply := &controlReply{}
+	if err := json.NewDecoder(conn).Decode(reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return reply, fmt.Errorf("%s", reply.Error)
+	}
+	return reply, nil
+}
+
+// ControlMounts asks the processes serving mounts on this host about their mounts.  Sockets left
+// by processes that are gone are removed.
+func ControlMounts() ([]*MountInfo, error) {
+	infos, _, err := controlMounts()
+	return infos, err
+}
+
+func controlMounts() ([]*MountInfo, map[string]string, error) {
+	dir := SocketDir()
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSocketDir(dir); err != nil {
+		return nil, nil, err
+	}
+	out := []*MountInfo{}
+	// socket by mountpoint
+	sockets := map[string]string{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".sock") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		reply, err := callControl(path, &controlRequest{Op: controlStatus})
+		if err != nil {
+			if isRefused(err) {
+				os.Remove(path)
+			}
+			continue
+		}
+		for _, info := range reply.Mounts {
+			sockets[info.Mountpoint] = path
+			out = append(out, info)
+		}
+	}
+	sort.Sort(mountInfoList(out))
+	return out, sockets, nil
+}
+
+func isRefused(err error) bool {
+	if op, is := err.(*net.OpError); is {
+		if sys, is := op.Err.(*os.SyscallError); is {
+			return sys.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+// FlushMount asks the process serving the mount to write what it holds back to the kv store.
+func FlushMount(mountpoint string) error {
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		mountpoint = abs
+	}
+	_, sockets, err := controlMounts()
+	if err != nil {
+		return err
+	}
+	path, has := sockets[mountpoint]
+	if !has {
+		return &ErrNotFound{mountpoint}
+	}
+	_, err = callControl(path, &controlRequest{Op: controlFlush, Mountpoint: mountpoint})
+	return err
+}
+
+type mountInfoList []*MountInfo
+
+func (l mountInfoList) Len() int           { return len(l) }
+func (l mountInfoList) Less(i, j int) bool { return l[i].Mountpoint < l[j].Mountpoint }
+func (l mountInfoList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,33 @@
+package kvfs
+
+import (
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type TestSuiteControl struct{}
+
+var _ = Suite(&TestSuiteControl{})
+
+func (suite *TestSuiteControl) TestCheckSocketDir(c *C) {
+	dir := filepath.Join(c.MkDir(), "kvfs")
+	c.Assert(os.Mkdir(dir, 0700), IsNil)
+	c.Assert(os.Chmod(dir, 0700), IsNil) // despite the umask
+	c.Assert(checkSocketDir(dir), IsNil)
+
+	c.Assert(os.Chmod(dir, 0777), IsNil)
+	c.Assert(checkSocketDir(dir), ErrorMatches, "Unsafe control socket directory .*")
+
+	link := dir + "-link"
+	c.Assert(os.Chmod(dir, 0700), IsNil)
+	c.Assert(os.Symlink(dir, link), IsNil)
+	c.Assert(checkSocketDir(link), ErrorMatches, "Unsafe control socket directory .*")
+
+	file := dir + "-file"
+	c.Assert(ioutil.WriteFile(file, nil, 0700), IsNil)
+	c.Assert(checkSocketDir(file), ErrorMatches, "Unsafe control socket directory .*")
+
+	c.Assert(os.IsNotExist(checkSocketDir(dir+"-missing")), Equals, true)
+}
@@ -0,0 +1,255 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Name of the hidden virtual control directory at the root of the mount.  It isn't listed
+	// in the root directory but can be looked up.
+	ControlDir = ".kvfs"
+)
+
+// CtlDir is a virtual directory that is not backed by the kv store.
+type CtlDir struct {
+	entries func() map[string]fs.Node
+}
+
+var _ = fs.Node(&CtlDir{})
+
+func (d *CtlDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+var _ = fs.HandleReadDirAller(&CtlDir{})
+
+func (d *CtlDir) ReadDirAll(c context.Context) ([]fuse.Dirent, error) {
+	names := []string{}
+	entries := d.entries()
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var res []fuse.Dirent
+	for _, name := range names {
+		de := fuse.Dirent{Name: name, Type: fuse.DT_File}
+		if _, is := entries[name].(fs.HandleReadDirAller); is {
+			de.Type = fuse.DT_Dir
+		}
+		res = append(res, de)
+	}
+	return res, nil
+}
+
+var _ = fs.NodeStringLookuper(&CtlDir{})
+
+func (d *CtlDir) Lookup(c context.Context, name string) (fs.Node, error) {
+	if n, has := d.entries()[name]; has {
+		return n, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// CtlFile is a virtual file whose content is generated on open.  If write is set, the file is
+// writable and write is called with the data written when the file is flushed.
+type CtlFile struct {
+	read  func(context.Context) ([]byte, error)
+	write func(context.Context, []byte) error
+}
+
+var _ = fs.Node(&CtlFile{})
+
+func (f *CtlFile) Attr(c context.Context, a *fuse.Attr) error {
+	a.Mode = 0
+	if f.read != nil {
+		a.Mode |= 0444
+	}
+	if f.write != nil {
+		a.Mode |= 0200
+	}
+	return nil
+}
+
+var _ = fs.NodeOpener(&CtlFile{})
+
+func (f *CtlFile) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() && f.write == nil {
+		return nil, fuse.EPERM
+	}
+	if !req.Flags.IsWriteOnly() && f.read == nil {
+		return nil, fuse.EPERM
+	}
+	h := &ctlHandle{file: f}
+	if f.read != nil && !req.Flags.IsWriteOnly() {
+		data, err := f.read(c)
+		if err != nil {
+			return nil, err
+		}
+		h.data = data
+	}
+	// The size isn't known until the content is generated, so bypass the page cache.
+	resp.Flags |= fuse.OpenDirectIO
+	return h, nil
+}
+
+// ctlHandle holds the content generated at open, or the data written so far.
+type ctlHandle struct {
+	file *CtlFile
+
+	mu      sync.Mutex
+	data    []byte
+	written []byte
+	dirty   bool
+}
+
+var _ = fs.HandleReader(&ctlHandle{})
+
+func (h *ctlHandle) Read(c context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fuseutil.HandleRead(req, resp, h.data)
+	return nil
+}
+
+var _ = fs.HandleWriter(&ctlHandle{})
+
+func (h *ctlHandle) Write(c context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.written = append(h.written, req.Data...)
+	h.dirty = true
+	resp.Size = len(req.Data)
+	return nil
+}
+
+var _ = fs.HandleFlusher(&ctlHandle{})
+
+func (h *ctlHandle) Flush(c context.Context, req *fuse.FlushRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.dirty {
+		return nil
+	}
+	h.dirty = false
+	data := h.written
+	h.written = nil
+	return h.file.write(c, data)
+}
+
+func textFile(fn func() string) *CtlFile {
+	return &CtlFile{
+		read: func(context.Context) ([]byte, error) {
+			return []byte(fn() + "\n"), nil
+		},
+	}
+}
+
+func jsonFile(fn func() interface{}) *CtlFile {
+	return &CtlFile{
+		read: func(context.Context) ([]byte, error) {
+			buff, err := json.MarshalIndent(fn(), "", "  ")
+			return append(buff, '\n'), err
+		},
+	}
+}
+
+const (
+	StatusConnected = "connected"
+	StatusDegraded  = "degraded"
+)
+
+// How long to wait for the kv store to answer before reporting the mount as degraded.
+const pingTimeout = 5 * time.Second
+
+func (f *FS) status() string {
+	result := make(chan error, 1)
+	go func() {
+		result <- f.db.Ping()
+	}()
+	status := StatusConnected
+	select {
+	case err := <-result:
+		if err != nil {
+			status = StatusDegraded + " " + err.Error()
+		}
+	case <-time.After(pingTimeout):
+		status = StatusDegraded + " timeout"
+	}
+	state, failures, err := f.db.Breaker.State()
+	status += fmt.Sprintf("\nbreaker %s failures=%d", state, failures)
+	if err != nil {
+		status += " last_error=" + err.Error()
+	}
+	return status
+}
+
+// flushCaches drops everything the mount caches locally.
+func (f *FS) flushCaches() {
+	if f.templates != nil {
+		f.templates.flush()
+	}
+	f.cache.flush()
+	f.quotas.flush()
+}
+
+func (f *FS) controlDir() *CtlDir {
+	cache := &CtlDir{
+		entries: func() map[string]fs.Node {
+			return map[string]fs.Node{
+				"flush": &CtlFile{
+					write: func(context.Context, []byte) error {
+						f.flushCaches()
+						return nil
+					},
+				},
+			}
+		},
+	}
+	return &CtlDir{
+		entries: func() map[string]fs.Node {
+			entries := map[string]fs.Node{
+				"backend":   textFile(f.db.String),
+				"status":    textFile(f.status),
+				"version":   textFile(func() string { return Version }),
+				"stats":     jsonFile(func() interface{} { return f.stats.Snapshot() }),
+				"events":    &EventsFile{hub: f.events},
+				"cache":     cache,
+				"snapshots": &ReadOnlyDir{fs: f, path: f.db.systemPath("snapshots")},
+			}
+			if f.history > 0 {
+				entries["history"] = &ReadOnlyDir{fs: f, path: f.db.systemPath("history"), value: historyValue}
+			}
+			if f.trash {
+				entries["trash"] = &ReadOnlyDir{fs: f, path: f.db.systemPath("trash")}
+			}
+			if f.journal != nil {
+				entries["journal"] = &CtlFile{
+					read: func(context.Context) ([]byte, error) {
+						status, err := f.journal.Status()
+						if err != nil {
+							return nil, err
+						}
+						buff, err := json.MarshalIndent(status, "", "  ")
+						return append(buff, '\n'), err
+					},
+				}
+			}
+			return entries
+		},
+	}
+}
@@ -3,9 +3,12 @@ package kvfs
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"errors"
 	"golang.org/x/net/context"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Dir struct {
@@ -14,25 +17,50 @@ type Dir struct {
 	path []string
 }
 
+// key returns the backend key of the named child.
+func (d *Dir) key(name string) string {
+	return filepath.Join(append(append(append([]string{}, d.fs.db.Root...), d.path...), name)...)
+}
+
 var _ = fs.Node(&Dir{})
 
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = rootInode
+	if len(d.path) > 0 {
+		a.Inode = inode(d.key(""))
+	}
 	a.Mode = os.ModeDir | 0755
 	return nil
 }
 
+var _ = fs.NodeForgetter(&Dir{})
+
+func (d *Dir) Forget() {
+	d.fs.forget(d.key(""), d)
+}
+
 var _ = fs.HandleReadDirAller(&Dir{})
 
-func (d *Dir) ReadDirAll(c context.Context) ([]fuse.Dirent, error) {
-	var res []fuse.Dirent
-	err := d.fs.db.View(c, func(ctx Context) error {
-		b := ctx.Dir(d.path)
-		if b == nil {
-			return errors.New("dir no longer exists")
-		}
+func (d *Dir) ReadDirAll(c context.Context) (res []fuse.Dirent, err error) {
+	defer d.fs.stats.fuseOp("ReadDirAll", time.Now(), &err)
+
+	var rendered, valued []string
+	err = d.fs.db.View(c, func(ctx Context) error {
+		b := ctx.StrictDir(d.path)
 		for entry := range b.Cursor() {
+			if entry.Err != nil {
+				return entry.Err
+			}
+			if entry.Dir && d.fs.dirValues == DirValuesSibling {
+				if has, err := d.hasValue(ctx, entry.Key); err != nil {
+					return err
+				} else if has {
+					valued = append(valued, entry.Key)
+				}
+			}
 			de := fuse.Dirent{
-				Name: entry.Key,
+				Inode: inode(d.key(entry.Key)),
+				Name:  entry.Key,
 			}
 			if entry.Dir {
 				de.Type = fuse.DT_Dir
@@ -40,59 +68,150 @@ func (d *Dir) ReadDirAll(c context.Context) ([]fuse.Dirent, error) {
 				de.Type = fuse.DT_File
 			}
 			res = append(res, de)
+			if d.fs.templates != nil && !entry.Dir && strings.HasSuffix(entry.Key, TemplateSuffix) {
+				rendered = append(rendered, strings.TrimSuffix(entry.Key, TemplateSuffix))
+			}
+		}
+		// Rendered templates don't shadow real entries.
+		for _, name := range rendered {
+			if !hasDirent(res, name) {
+				res = append(res, fuse.Dirent{Inode: inode(d.key(name)), Name: name, Type: fuse.DT_File})
+			}
+		}
+		// Nor do the values of directories.
+		for _, name := range valued {
+			if !hasDirent(res, name+DirValueSuffix) {
+				res = append(res, fuse.Dirent{Inode: dirValueInode(d.key(name)), Name: name + DirValueSuffix, Type: fuse.DT_File})
+			}
+		}
+		if parent, name, ok := d.valueOf(DirValueFile); ok && !hasDirent(res, DirValueFile) {
+			if has, err := parent.hasValue(ctx, name); err != nil {
+				return err
+			} else if has {
+				res = append(res, fuse.Dirent{Inode: dirValueInode(d.key("")), Name: DirValueFile, Type: fuse.DT_File})
+			}
+		}
+		// Files with writes not yet replayed, e.g. created while the kv store was unreachable
+		if j := d.fs.journal; j != nil {
+			for _, name := range j.Names(d.key("")) {
+				if !hasDirent(res, name) {
+					res = append(res, fuse.Dirent{Inode: inode(d.key(name)), Name: name, Type: fuse.DT_File})
+				}
+			}
 		}
 		return nil
 	})
-	return res, err
+	return res, errno(err)
+}
+
+func hasDirent(list []fuse.Dirent, name string) bool {
+	for _, de := range list {
+		if de.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 var _ = fs.NodeStringLookuper(&Dir{})
 
-func (d *Dir) Lookup(c context.Context, name string) (fs.Node, error) {
-	var n fs.Node
-	err := d.fs.db.View(c, func(ctx Context) error {
-		b := ctx.Dir(d.path)
-		if b == nil {
-			return errors.New("dir no longer exists")
-		}
-		if child := b.Dir(name); child != nil {
-			// directory
-			dirs := make([]string, len(d.path)+1)
-			dirs = append(dirs, d.path...)
-			dirs = append(dirs, name)
-			n = &Dir{
-				fs:   d.fs,
-				path: dirs,
+func (d *Dir) Lookup(c context.Context, name string) (n fs.Node, err error) {
+	defer d.fs.stats.fuseOp("Lookup", time.Now(), &err)
+
+	if len(d.path) == 0 && name == ControlDir {
+		return d.fs.controlDir(), nil
+	}
+	if IsMarker(name) {
+		return nil, fuse.ENOENT
+	}
+	if j := d.fs.journal; j != nil {
+		// A write not yet replayed, maybe of a file created while the kv store was unreachable
+		if _, pending := j.Get(d.key(name)); pending {
+			return d.file(name), nil
+		}
+	}
+	err = d.fs.db.View(c, func(ctx Context) error {
+		b := ctx.StrictDir(d.path)
+		stat, err := b.Stat(name)
+		if _, is := err.(*ErrBackendUnavailable); is {
+			if _, has := d.fs.cache.stale(d.key(name)); has {
+				// A file whose value is served stale.  Directories aren't cached.
+				n = d.file(name)
+				return nil
+			}
+		}
+		if _, is := err.(*ErrNotFound); is {
+			if parent, dir, ok := d.valueOf(name); ok {
+				if has, err := parent.hasValue(ctx, dir); err != nil {
+					return err
+				} else if has {
+					n = parent.dirValue(dir)
+					return nil
+				}
 			}
-			return nil
 		}
-		if child := b.Get(name); child != nil {
-			// file
-			n = &File{
-				dir:  d,
-				name: name,
+		if _, is := err.(*ErrNotFound); is && d.fs.templates != nil {
+			if _, err := b.Get(name + TemplateSuffix); err != nil {
+				return err
+			}
+			// rendered template
+			n = &TemplateFile{
+				dir:      d,
+				name:     name,
+				renderer: d.fs.templates.renderer(d.path, name+TemplateSuffix),
 			}
 			return nil
 		}
-		return fuse.ENOENT
+		if err != nil {
+			return err
+		}
+		if stat.Dir {
+			n = d.dir(name)
+			return nil
+		}
+		n = d.file(name)
+		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, errno(err)
 	}
 	return n, nil
 }
 
+// dir returns the node of the named subdirectory, the one already serving it if any.
+func (d *Dir) dir(name string) fs.Node {
+	return d.fs.node(d.key(name), true, func() fs.Node {
+		return &Dir{fs: d.fs, path: append(append([]string{}, d.path...), name)}
+	})
+}
+
+// file returns the node of the named file, the one already serving it if any, so all the handles
+// of a file share its state.
+func (d *Dir) file(name string) fs.Node {
+	return d.fs.node(d.key(name), false, func() fs.Node {
+		return &File{dir: d, name: name}
+	})
+}
+
 var _ = fs.NodeMkdirer(&Dir{})
 
-func (d *Dir) Mkdir(c context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+func (d *Dir) Mkdir(c context.Context, req *fuse.MkdirRequest) (n fs.Node, err error) {
+	defer d.fs.stats.fuseOp("Mkdir", time.Now(), &err)
+	defer d.fs.audit.op("Mkdir", &req.Header, d.key(req.Name), &err)
+
 	name := req.Name
-	err := d.fs.db.Update(c, func(ctx Context) error {
-		b := ctx.Dir(d.path)
-		if b == nil {
-			return errors.New("dir no longer exists")
-		}
-		if child := b.Dir(name); child != nil {
+	if IsMarker(name) {
+		return nil, fuse.EPERM
+	}
+	err = d.fs.db.Update(c, func(ctx Context) error {
+		b := ctx.StrictDir(d.path)
+		if _, err := b.Stat(name); err == nil {
 			return fuse.EEXIST
+		} else if _, is := err.(*ErrNotFound); !is {
+			return err
+		}
+		if err := d.fs.quotas.checkEntries(d.path); err != nil {
+			return err
 		}
 		if _, err := b.CreateDir(name); err != nil {
 			return err
@@ -100,21 +219,44 @@ func (d *Dir) Mkdir(c context.Context, req *fuse.MkdirRequest) (fs.Node, error)
 		return nil
 	})
 	if err != nil {
-		return nil, err
-	}
-	dirs := make([]string, len(d.path)+1)
-	dirs = append(dirs, d.path...)
-	dirs = append(dirs, name)
-	n := &Dir{
-		fs:   d.fs,
-		path: dirs,
+		return nil, errno(err)
 	}
-	return n, nil
+	d.fs.quotas.charge(d.path, 0, 1, 0)
+	return d.dir(name), nil
 }
 
 var _ = fs.NodeCreater(&Dir{})
 
-func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	defer d.fs.stats.fuseOp("Create", time.Now(), &err)
+	defer d.fs.audit.op("Create", &req.Header, d.key(req.Name), &err)
+
+	if IsMarker(req.Name) {
+		return nil, nil, fuse.EPERM
+	}
+	if parent, dir, ok := d.valueOf(req.Name); ok {
+		// The value of a directory that has none yet
+		var isDir bool
+		err = d.fs.db.View(ctx, func(ctx Context) (err error) {
+			isDir, err = parent.isDir(ctx, dir)
+			return err
+		})
+		if err != nil {
+			return nil, nil, errno(err)
+		}
+		if isDir {
+			f := parent.dirValue(dir)
+			f.writers = 1
+			// The key of the directory exists, in zk at least, so the write isn't checked.
+			f.base = BaseAny
+			f.dirty = true
+			return f, f, nil
+		}
+	}
+	if err := d.fs.quotas.checkEntries(d.path); err != nil {
+		return nil, nil, errno(err)
+	}
+	d.fs.quotas.charge(d.path, 1, 0, 0)
 
 	name := req.Name
 	f := &File{
@@ -122,37 +264,109 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		name:    name,
 		writers: 1,
 		// file is empty at Create time, no need to set data
+		base: BaseNew,
+		// the key is only written on flush
+		dirty: true,
 	}
+	d.fs.setNode(d.key(name), f)
 	return f, f, nil
 }
 
 var _ = fs.NodeRemover(&Dir{})
 
-func (d *Dir) Remove(c context.Context, req *fuse.RemoveRequest) error {
-	name := req.Name
-	return d.fs.db.Update(c, func(ctx Context) error {
-		b := ctx.Dir(d.path)
-		if b == nil {
-			return errors.New("dir no longer exists")
-		}
+func (d *Dir) Remove(c context.Context, req *fuse.RemoveRequest) (err error) {
+	defer d.fs.stats.fuseOp("Remove", time.Now(), &err)
+	defer d.fs.audit.op("Remove", &req.Header, d.key(req.Name), &err)
+	defer d.fs.cache.invalidate(d.key(req.Name))
+	defer d.fs.dropNode(d.key(req.Name))
 
-		switch req.Dir {
-		case true:
-			if b.Dir(name) == nil {
-				return fuse.ENOENT
-			}
-			if err := b.DeleteDir(name); err != nil {
+	name := req.Name
+	err = d.fs.db.Update(c, func(ctx Context) error {
+		b := ctx.StrictDir(d.path)
+		if req.Dir {
+			if d.fs.trash {
+				// DeleteDir checks this itself.
+				if stat, err := b.Stat(name); err != nil {
+					return err
+				} else if !stat.Dir {
+					return &ErrNotDir{d.key(name)}
+				}
+				_, err := d.fs.db.Trash(append(append([]string{}, d.path...), name), req.Uid)
 				return err
 			}
-
-		case false:
-			if b.Get(name) == nil {
-				return fuse.ENOENT
-			}
-			if err := b.Delete(name); err != nil {
-				return err
+			return b.DeleteDir(name)
+		}
+		stat, err := b.Stat(name)
+		if _, is := err.(*ErrNotFound); is {
+			if parent, dir, ok := d.valueOf(name); ok {
+				return parent.removeValue(ctx, dir)
 			}
 		}
+		if err != nil {
+			return err
+		}
+		if stat.Dir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if d.fs.trash {
+			_, err = d.fs.db.Trash(append(append([]string{}, d.path...), name), req.Uid)
+		} else {
+			err = b.Delete(name)
+		}
+		if err != nil {
+			return err
+		}
+		d.fs.quotas.charge(d.path, -1, 0, -int64(stat.Size))
 		return nil
 	})
+	if err == nil && req.Dir {
+		// The entries below it are counted again when the usage is next read.
+		d.fs.quotas.charge(d.path, 0, -1, 0)
+	}
+	return errno(err)
+}
+
+var _ = fs.NodeRenamer(&Dir{})
+
+// Rename moves a file by copying its value to the new key and deleting the old one.  Directories
+// are not renamed, but EXDEV tells tools like mv to fall back to copying the tree.
+func (d *Dir) Rename(c context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	defer d.fs.stats.fuseOp("Rename", time.Now(), &err)
+
+	target, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.EIO
+	}
+	if IsMarker(req.OldName) || IsMarker(req.NewName) {
+		return fuse.EPERM
+	}
+	defer d.fs.audit.rename(&req.Header, d.key(req.OldName), target.key(req.NewName), &err)
+	defer d.fs.cache.invalidate(d.key(req.OldName))
+	defer d.fs.cache.invalidate(target.key(req.NewName))
+	defer d.fs.dropNode(d.key(req.OldName))
+	defer d.fs.dropNode(target.key(req.NewName))
+
+	err = d.fs.db.Update(c, func(ctx Context) error {
+		from := ctx.StrictDir(d.path)
+		stat, err := from.Stat(req.OldName)
+		if err != nil {
+			return err
+		}
+		if stat.Dir {
+			return fuse.Errno(syscall.EXDEV)
+		}
+		v, err := from.Get(req.OldName)
+		if err != nil {
+			return err
+		}
+		to := ctx.StrictDir(target.path)
+		if stat, err := to.Stat(req.NewName); err == nil && stat.Dir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if err := to.Put(req.NewName, v); err != nil {
+			return err
+		}
+		return from.Delete(req.OldName)
+	})
+	return errno(err)
 }
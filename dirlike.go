@@ -3,6 +3,7 @@ package kvfs
 import (
 	"github.com/docker/libkv/store"
 	"path/filepath"
+	"strings"
 )
 
 type Entry struct {
@@ -21,11 +22,51 @@ type DirLike interface {
 	Delete(key string) error
 }
 
+// Stat describes an entry of a directory.
+type Stat struct {
+	Name string
+	Dir  bool
+	// Size and LastIndex are only set for files.
+	Size      int
+	LastIndex uint64
+}
+
+// StrictDirLike is the error returning variant of DirLike, so callers can tell a missing entry
+// (*ErrNotFound) from a file (*ErrNotDir) or a kv store that's down (*ErrBackendUnavailable).
+// If listing fails, Cursor sends an Entry with Err set before closing the channel.
+type StrictDirLike interface {
+	Dir(name string) (StrictDirLike, error)
+	CreateDir(name string) (StrictDirLike, error)
+	DeleteDir(name string) error
+	Cursor() <-chan *Entry
+	Get(key string) ([]byte, error)
+	// GetPair is Get with the LastIndex of the value, for writes that are checked against it.
+	GetPair(key string) (*store.KVPair, error)
+	Stat(name string) (*Stat, error)
+	Put(key string, value []byte) error
+	// AtomicPut writes the value if the key is still at previous.LastIndex, or doesn't exist if
+	// previous is nil.  It returns *ErrConflict otherwise.
+	AtomicPut(key string, value []byte, previous *store.KVPair) (*store.KVPair, error)
+	Delete(key string) error
+}
+
 const (
 	// I want to shoot myself.  Etcd doesn't like __dir__. So changing to use ~
 	DirMarker = "~dir~"
+	// Holds the quota of a directory, as json
+	QuotaMarker = "~quota~"
+	// Directory below the root that holds the history, snapshots and trash
+	SystemDir = "~kvfs~"
+	// Prefix of the markers that hide a deleted entry of the lower layers of a union
+	WhiteoutPrefix = "~wh~"
 )
 
+// IsMarker returns true for the reserved names of entries that hold data about their directory or
+// the mount and are not listed.
+func IsMarker(name string) bool {
+	return name == DirMarker || name == QuotaMarker || name == SystemDir || strings.HasPrefix(name, WhiteoutPrefix)
+}
+
 type dir struct {
 	store   store.Store
 	path    []string
@@ -36,26 +77,57 @@ func NewDirLike(store store.Store, path []string, handler *Handler) DirLike {
 	return &dir{store: store, path: path, handler: handler}
 }
 
+func NewStrictDirLike(store store.Store, path []string, handler *Handler) StrictDirLike {
+	return &strictDir{dir{store: store, path: path, handler: handler}}
+}
+
 func (this dir) Dir(name string) DirLike {
+	if child, err := this.subdir(name); err == nil && child != nil {
+		return child
+	}
+	return nil
+}
+
+func (this dir) child(name string) *dir {
 	child := this
-	child.path = append(child.path, name)
-	p := filepath.Join(child.path...)
-	children, err := this.store.List(p)
-	if err != nil {
-		return nil
+	child.path = append(append([]string{}, this.path...), name)
+	return &child
+}
+
+// subdir returns the named subdirectory, or nil if there's no key with children by that name.
+func (this dir) subdir(name string) (*dir, error) {
+	child := this.child(name)
+	children, err := this.store.List(filepath.Join(child.path...))
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
 	}
 	if len(children) > 0 {
-		return &child
+		return child, nil
 	}
-	return nil
+	return nil, nil
+}
+
+// strictSubdir is subdir but tells a file from a missing entry.
+func (this dir) strictSubdir(name string) (*dir, error) {
+	child, err := this.subdir(name)
+	if err != nil || child != nil {
+		return child, err
+	}
+	p := filepath.Join(append(this.path, name)...)
+	if exists, err := this.store.Exists(p); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, &ErrNotDir{p}
+	}
+	return nil, &ErrNotFound{p}
 }
 
 // Call the backend specific handlers to process the name / key convention.
-// If the Marker entry is found, return "" and have it filtered out during the Cursor() listing.
+// If a Marker entry is found, return "" and have it filtered out during the Cursor() listing.
 func (this dir) nameFromKey(parent, child string) string {
 	if this.handler != nil {
 		key := this.handler.NameFromKey(parent, child)
-		if key == DirMarker {
+		if IsMarker(key) {
 			return ""
 		} else {
 			return key
@@ -70,7 +142,11 @@ func (this dir) Cursor() <-chan *Entry {
 		defer close(out)
 		parent := filepath.Join(this.path...)
 		list, err := this.store.List(parent)
+		if err == store.ErrKeyNotFound {
+			return
+		}
 		if err != nil {
+			out <- &Entry{Err: err}
 			return
 		}
 
@@ -88,6 +164,9 @@ func (this dir) Cursor() <-chan *Entry {
 				if _, has := unique[child]; !has {
 					p := filepath.Join(append(this.path, child)...)
 					children, err := this.store.List(p) // Ouch...
+					if err == store.ErrKeyNotFound {
+						err = nil // a file
+					}
 					out <- &Entry{
 						Key: child,
 						Dir: len(children) > 0,
@@ -102,8 +181,15 @@ func (this dir) Cursor() <-chan *Entry {
 }
 
 func (this dir) CreateDir(name string) (DirLike, error) {
-	child := this
-	child.path = append(child.path, name)
+	child, err := this.createDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+func (this dir) createDir(name string) (*dir, error) {
+	child := this.child(name)
 
 	// Create a node one level below to signify this is a folder.  Otherwise, a list will
 	// just return 0 children and show this as a file.
@@ -112,17 +198,28 @@ func (this dir) CreateDir(name string) (DirLike, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &child, nil
+	return child, nil
 }
 
 // Deletes the entire directory -- this means for some kvstores this operation will
 // recursively deletes all children.  This is a workaround of the DeleteTree method
 // in libkv, which throws api error with zk.
 func (this dir) DeleteDir(name string) error {
+	if this.handler != nil && this.handler.DeleteDir != nil {
+		p := filepath.Join(append(this.path, name)...)
+		if err := this.handler.DeleteDir(this.store, p); err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+		return nil
+	}
+
 	// remove any contents of the directory / subtree
 	d := this.Dir(name)
 	if d != nil {
 		for entry := range d.Cursor() {
+			if entry.Err != nil {
+				return entry.Err
+			}
 			if entry.Dir {
 				if err := d.DeleteDir(entry.Key); err != nil {
 					return err
@@ -140,6 +237,7 @@ func (this dir) DeleteDir(name string) error {
 	// However for some backends like zk, N+1 deletion is required to clear the tree (4 children + 1 parent node).
 	p := filepath.Join(append(this.path, name)...)
 	this.store.Delete(p + "/" + DirMarker) // best effort to make this workable with directories created outside this lib.
+	this.store.Delete(p + "/" + QuotaMarker)
 
 	// Zk needs to call Delete but etcd and consul it's DeleteTree -- so this is left to a handler function
 	if err := this.handler.DeleteEmptyParent(this.store, p); err != nil {
@@ -153,13 +251,47 @@ func (this dir) DeleteDir(name string) error {
 }
 
 func (this dir) Get(key string) []byte {
-	kv, err := this.store.Get(filepath.Join(append(this.path, key)...))
+	v, err := this.get(key)
 	if err == nil {
-		return kv.Value
+		return v
 	}
 	return nil
 }
 
+func (this dir) get(key string) ([]byte, error) {
+	kv, err := this.getPair(key)
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
+
+func (this dir) getPair(key string) (*store.KVPair, error) {
+	p := filepath.Join(append(this.path, key)...)
+	kv, err := this.store.Get(p)
+	if err == store.ErrKeyNotFound {
+		return nil, &ErrNotFound{p}
+	}
+	return kv, err
+}
+
+func (this dir) stat(name string) (*Stat, error) {
+	if child, err := this.subdir(name); err != nil {
+		return nil, err
+	} else if child != nil {
+		return &Stat{Name: name, Dir: true}, nil
+	}
+	p := filepath.Join(append(this.path, name)...)
+	kv, err := this.store.Get(p)
+	if err == store.ErrKeyNotFound {
+		return nil, &ErrNotFound{p}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Stat{Name: name, Size: len(kv.Value), LastIndex: kv.LastIndex}, nil
+}
+
 func (this dir) Put(key string, value []byte) error {
 	return this.store.Put(filepath.Join(append(this.path, key)...), value, nil)
 }
@@ -175,3 +307,61 @@ func (this dir) Delete(key string) error {
 	}
 	return nil
 }
+
+// strictDir implements StrictDirLike on top of the same conventions as dir.
+type strictDir struct {
+	dir
+}
+
+func (this strictDir) Dir(name string) (StrictDirLike, error) {
+	child, err := this.dir.strictSubdir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &strictDir{*child}, nil
+}
+
+func (this strictDir) CreateDir(name string) (StrictDirLike, error) {
+	child, err := this.dir.createDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &strictDir{*child}, nil
+}
+
+func (this strictDir) Get(key string) ([]byte, error) {
+	return this.dir.get(key)
+}
+
+func (this strictDir) GetPair(key string) (*store.KVPair, error) {
+	return this.dir.getPair(key)
+}
+
+func (this strictDir) AtomicPut(key string, value []byte, previous *store.KVPair) (*store.KVPair, error) {
+	p := filepath.Join(append(this.path, key)...)
+	_, kv, err := this.store.AtomicPut(p, value, previous, nil)
+	if err == store.ErrKeyModified || err == store.ErrKeyExists {
+		return nil, &ErrConflict{p}
+	}
+	return kv, err
+}
+
+func (this strictDir) Stat(name string) (*Stat, error) {
+	return this.dir.stat(name)
+}
+
+// DeleteDir returns *ErrNotFound if the directory doesn't exist.
+func (this strictDir) DeleteDir(name string) error {
+	if _, err := this.dir.strictSubdir(name); err != nil {
+		return err
+	}
+	return this.dir.DeleteDir(name)
+}
+
+// Delete returns *ErrNotFound if the key doesn't exist.
+func (this strictDir) Delete(key string) error {
+	if _, err := this.dir.get(key); err != nil {
+		return err
+	}
+	return this.dir.Delete(key)
+}
@@ -0,0 +1,114 @@
+package kvfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// In zk and consul a key can have a value and keys below it.  The mount shows such a key as a
+// directory, and with Config.DirValues also as a file that reads and writes the value of the key.
+const (
+	// A .value file inside the directory, e.g. b/.value
+	DirValuesInside = "inside"
+	// A <name>.value file next to the directory, e.g. b.value
+	DirValuesSibling = "sibling"
+
+	// Name of the value of a directory inside it
+	DirValueFile = ".value"
+	// Suffix of the value of a directory next to it
+	DirValueSuffix = ".value"
+)
+
+func checkDirValues(mode string) error {
+	switch mode {
+	case "", DirValuesInside, DirValuesSibling:
+		return nil
+	}
+	return fmt.Errorf("Unknown dir_values %q, want %s or %s", mode, DirValuesInside, DirValuesSibling)
+}
+
+// dirValueInode returns the inode of the value of the directory at key, which is not the inode of
+// the directory.
+func dirValueInode(key string) uint64 {
+	return inode(key + "/" + DirValueFile)
+}
+
+// dirsHaveValues returns false if the directories of the store can't have values, as in etcd.
+func (this *Backend) dirsHaveValues() bool {
+	return this.Url.Scheme != "etcd"
+}
+
+// valueOf returns the directory and the name in it of the directory whose value is the entry name
+// of d.  It's false if the name isn't one of a directory value, or the store has none, so in etcd
+// the name is a file like any other; real keys by the same name take precedence and are checked
+// by the caller.
+func (d *Dir) valueOf(name string) (*Dir, string, bool) {
+	if !d.fs.db.dirsHaveValues() {
+		return nil, "", false
+	}
+	switch d.fs.dirValues {
+	case DirValuesInside:
+		if name == DirValueFile && len(d.path) > 0 {
+			return &Dir{fs: d.fs, path: d.path[:len(d.path)-1]}, d.path[len(d.path)-1], true
+		}
+	case DirValuesSibling:
+		if dir := strings.TrimSuffix(name, DirValueSuffix); dir != name && dir != "" && !IsMarker(dir) {
+			return d, dir, true
+		}
+	}
+	return nil, "", false
+}
+
+// isDir returns true if the named entry of d is a directory.
+func (d *Dir) isDir(ctx Context, name string) (bool, error) {
+	stat, err := ctx.StrictDir(d.path).Stat(name)
+	if _, is := err.(*ErrNotFound); is {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return stat.Dir, nil
+}
+
+// hasValue returns true if the named entry of d is a directory with a value.  In zk every
+// directory has a key, which is empty unless written by another tool; in etcd directories can't
+// have values.
+func (d *Dir) hasValue(ctx Context, name string) (bool, error) {
+	if dir, err := d.isDir(ctx, name); err != nil || !dir {
+		return false, err
+	}
+	v, err := ctx.StrictDir(d.path).Get(name)
+	if _, is := err.(*ErrNotFound); is {
+		// consul has no key for a directory made of the keys below it
+		return false, nil
+	}
+	return len(v) > 0, err
+}
+
+// dirValue returns the file of the value of the named directory of d.  It isn't kept in the nodes
+// of the FS, which has the directory by the same key.
+func (d *Dir) dirValue(name string) *File {
+	return &File{dir: d, name: name, dirValue: true}
+}
+
+// removeValue empties the value of the named directory of d.  The key stays, as zk can't delete
+// a key with keys below it.
+func (d *Dir) removeValue(ctx Context, name string) error {
+	defer d.fs.cache.invalidate(d.key(name))
+	if has, err := d.hasValue(ctx, name); err != nil {
+		return err
+	} else if !has {
+		return &ErrNotFound{d.key(name)}
+	}
+	b := ctx.StrictDir(d.path)
+	kv, err := b.GetPair(name)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(name, []byte{}); err != nil {
+		return err
+	}
+	d.fs.quotas.charge(d.path, 0, 0, -int64(len(kv.Value)))
+	return nil
+}
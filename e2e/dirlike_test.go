@@ -206,3 +206,49 @@ func (suite *TestSuiteDirLike) TestPutGetAndDelete(c *C) {
 		c.Assert(v, IsNil)
 	}
 }
+
+func (suite *TestSuiteDirLike) TestStrictDirLike(c *C) {
+	for _, url := range kvstores() {
+		u := url.String() + "/" + path.Join(testRoot, "a")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+
+		ctx := b.Context(nil)
+		dir := ctx.StrictDir([]string{})
+		c.Log("store=", u)
+
+		dirB, err := dir.Dir("b") // a/b but b is not a subtree
+		c.Assert(dirB, IsNil)
+		c.Assert(err, FitsTypeOf, &kvfs.ErrNotDir{})
+
+		dirX, err := dir.Dir("x")
+		c.Assert(dirX, IsNil)
+		c.Assert(err, FitsTypeOf, &kvfs.ErrNotFound{})
+
+		dirC, err := dir.Dir("c")
+		c.Assert(err, IsNil)
+		c.Assert(dirC, Not(IsNil))
+
+		v, err := dir.Get("b")
+		c.Assert(err, IsNil)
+		c.Assert(v, DeepEquals, []byte("a/b"))
+
+		_, err = dir.Get("x")
+		c.Assert(err, FitsTypeOf, &kvfs.ErrNotFound{})
+
+		stat, err := dir.Stat("b")
+		c.Assert(err, IsNil)
+		c.Assert(stat.Dir, Equals, false)
+		c.Assert(stat.Size, Equals, len("a/b"))
+
+		stat, err = dir.Stat("c")
+		c.Assert(err, IsNil)
+		c.Assert(stat.Dir, Equals, true)
+
+		_, err = dir.Stat("x")
+		c.Assert(err, FitsTypeOf, &kvfs.ErrNotFound{})
+
+		err = dir.Delete("x")
+		c.Assert(err, FitsTypeOf, &kvfs.ErrNotFound{})
+	}
+}
@@ -0,0 +1,173 @@
+package e2e
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/conductant/kvfs"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestDirValue(t *testing.T) { TestingT(t) }
+
+type TestSuiteDirValue struct {
+	testStores
+}
+
+var _ = Suite(&TestSuiteDirValue{})
+
+func (suite *TestSuiteDirValue) SetUpSuite(c *C) {
+	suite.setUp(c, "dirvalue")
+	for i, s := range suite.stores {
+		s.Put(testRoot+"dirvalue/~dir~", []byte{1}, nil)
+		// a tree per mode
+		for _, mode := range []string{"sibling", "inside"} {
+			s.Put(testRoot+"dirvalue/"+mode+"/~dir~", []byte{1}, nil)
+			s.Put(testRoot+"dirvalue/"+mode+"/db/~dir~", []byte{1}, nil)
+			s.Put(testRoot+"dirvalue/"+mode+"/db/host", []byte("db1"), nil)
+			s.Put(testRoot+"dirvalue/"+mode+"/cache/~dir~", []byte{1}, nil)
+			s.Put(testRoot+"dirvalue/"+mode+"/cache/size", []byte("10"), nil)
+			if kvstores()[i].Scheme != "etcd" {
+				// a value written by another tool to the key of the directory
+				s.Put(testRoot+"dirvalue/"+mode+"/db", []byte("primary"), nil)
+			}
+		}
+	}
+}
+
+func (suite *TestSuiteDirValue) TearDownSuite(c *C) {
+	suite.tearDown(c)
+}
+
+func (suite *TestSuiteDirValue) TestSibling(c *C) {
+	ctx := context.Background()
+	for i, url := range kvstores() {
+		s := suite.stores[i]
+		u := url.String() + "/" + path.Join(testRoot, "dirvalue", "sibling")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+		filesystem, err := kvfs.NewFS(b, &kvfs.Config{DirValues: kvfs.DirValuesSibling})
+		c.Assert(err, IsNil)
+		root, err := filesystem.Root()
+		c.Assert(err, IsNil)
+		dir := root.(*kvfs.Dir)
+
+		if url.Scheme == "etcd" {
+			// Directories have no values, so db.value is a file like any other.
+			_, err = dir.Lookup(ctx, "db.value")
+			c.Assert(err, Equals, fuse.ENOENT)
+			n, _, err := dir.Create(ctx, &fuse.CreateRequest{Name: "db.value"}, &fuse.CreateResponse{})
+			c.Assert(err, IsNil)
+			f := n.(*kvfs.File)
+			c.Assert(f.Write(ctx, &fuse.WriteRequest{Data: []byte("primary")}, &fuse.WriteResponse{}), IsNil)
+			c.Assert(f.Flush(ctx, &fuse.FlushRequest{}), IsNil)
+			kv, err := s.Get(testRoot + "dirvalue/sibling/db.value")
+			c.Assert(err, IsNil)
+			c.Assert(string(kv.Value), Equals, "primary")
+			filesystem.Stop()
+			continue
+		}
+
+		entries, err := dir.ReadDirAll(ctx)
+		c.Assert(err, IsNil)
+		c.Assert(direntNames(entries), DeepEquals, []string{"cache", "db", "db.value"})
+
+		n, err := dir.Lookup(ctx, "db.value")
+		c.Assert(err, IsNil)
+		resp := &fuse.ReadResponse{}
+		c.Assert(n.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 100}, resp), IsNil)
+		c.Assert(string(resp.Data), Equals, "primary")
+
+		c.Assert(dir.Remove(ctx, &fuse.RemoveRequest{Name: "db.value"}), IsNil)
+		_, err = dir.Lookup(ctx, "db.value")
+		c.Assert(err, Equals, fuse.ENOENT)
+		// the directory stays
+		kv, err := s.Get(testRoot + "dirvalue/sibling/db/host")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "db1")
+		filesystem.Stop()
+	}
+}
+
+func (suite *TestSuiteDirValue) TestInside(c *C) {
+	ctx := context.Background()
+	for i, url := range kvstores() {
+		if url.Scheme == "etcd" {
+			// Directories have no values; see TestSibling.
+			continue
+		}
+		s := suite.stores[i]
+		inside := testRoot + "dirvalue/inside/"
+		u := url.String() + "/" + path.Join(testRoot, "dirvalue", "inside")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+		filesystem, err := kvfs.NewFS(b, &kvfs.Config{DirValues: kvfs.DirValuesInside})
+		c.Assert(err, IsNil)
+		root, err := filesystem.Root()
+		c.Assert(err, IsNil)
+		dir := root.(*kvfs.Dir)
+
+		// The root has no parent to hold its value.
+		entries, err := dir.ReadDirAll(ctx)
+		c.Assert(err, IsNil)
+		c.Assert(direntNames(entries), DeepEquals, []string{"cache", "db"})
+		_, err = dir.Lookup(ctx, kvfs.DirValueFile)
+		c.Assert(err, Equals, fuse.ENOENT)
+
+		// read
+		n, err := dir.Lookup(ctx, "db")
+		c.Assert(err, IsNil)
+		db := n.(*kvfs.Dir)
+		entries, err = db.ReadDirAll(ctx)
+		c.Assert(err, IsNil)
+		c.Assert(direntNames(entries), DeepEquals, []string{".value", "host"})
+		n, err = db.Lookup(ctx, kvfs.DirValueFile)
+		c.Assert(err, IsNil)
+		resp := &fuse.ReadResponse{}
+		c.Assert(n.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 100}, resp), IsNil)
+		c.Assert(string(resp.Data), Equals, "primary")
+
+		// write a new value
+		n, err = dir.Lookup(ctx, "cache")
+		c.Assert(err, IsNil)
+		cache := n.(*kvfs.Dir)
+		_, err = cache.Lookup(ctx, kvfs.DirValueFile)
+		c.Assert(err, Equals, fuse.ENOENT)
+		n, _, err = cache.Create(ctx, &fuse.CreateRequest{Name: kvfs.DirValueFile}, &fuse.CreateResponse{})
+		c.Assert(err, IsNil)
+		f := n.(*kvfs.File)
+		c.Assert(f.Write(ctx, &fuse.WriteRequest{Data: []byte("lru")}, &fuse.WriteResponse{}), IsNil)
+		c.Assert(f.Flush(ctx, &fuse.FlushRequest{}), IsNil)
+		kv, err := s.Get(inside + "cache")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "lru")
+		entries, err = cache.ReadDirAll(ctx)
+		c.Assert(err, IsNil)
+		c.Assert(direntNames(entries), DeepEquals, []string{".value", "size"})
+
+		// remove
+		c.Assert(db.Remove(ctx, &fuse.RemoveRequest{Name: kvfs.DirValueFile}), IsNil)
+		_, err = db.Lookup(ctx, kvfs.DirValueFile)
+		c.Assert(err, Equals, fuse.ENOENT)
+		kv, err = s.Get(inside + "db")
+		c.Assert(err, IsNil)
+		c.Assert(len(kv.Value), Equals, 0)
+		kv, err = s.Get(inside + "db/host")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "db1")
+		filesystem.Stop()
+	}
+}
+
+// direntNames returns the sorted names of the entries.
+func direntNames(entries []fuse.Dirent) []string {
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	return names
+}
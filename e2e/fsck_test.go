@@ -0,0 +1,75 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	. "gopkg.in/check.v1"
+	"path"
+	"testing"
+)
+
+func TestFsck(t *testing.T) { TestingT(t) }
+
+type TestSuiteFsck struct {
+	testStores
+}
+
+var _ = Suite(&TestSuiteFsck{})
+
+func (suite *TestSuiteFsck) SetUpSuite(c *C) {
+	suite.setUp(c, "fsck")
+	for _, s := range suite.stores {
+		s.Put(testRoot+"fsck/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"fsck/app/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"fsck/app/port", []byte("8080"), nil)
+		// written by another tool
+		s.Put(testRoot+"fsck/app/db/host", []byte("db1"), nil)
+		// left by a directory that was deleted
+		s.Put(testRoot+"fsck/gone/~quota~", []byte("{}"), nil)
+	}
+}
+
+func (suite *TestSuiteFsck) TearDownSuite(c *C) {
+	suite.tearDown(c)
+}
+
+func (suite *TestSuiteFsck) TestFsck(c *C) {
+	for i, url := range kvstores() {
+		s := suite.stores[i]
+		u := url.String() + "/" + path.Join(testRoot, "fsck")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+
+		problems, err := b.Fsck(nil, false)
+		c.Assert(err, IsNil)
+		c.Assert(len(problems), Equals, 2)
+		c.Assert(problems[0].Path, Equals, "/app/db")
+		c.Assert(problems[0].Kind, Equals, kvfs.FsckMissingMarker)
+		c.Assert(problems[0].Fixed, Equals, false)
+		c.Assert(problems[1].Path, Equals, "/gone/~quota~")
+		c.Assert(problems[1].Kind, Equals, kvfs.FsckOrphanMarker)
+
+		// A dry run changes nothing.
+		exists, err := s.Exists(testRoot + "fsck/app/db/~dir~")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, false)
+
+		problems, err = b.Fsck([]string{"app"}, true)
+		c.Assert(err, IsNil)
+		c.Assert(len(problems), Equals, 1)
+		c.Assert(problems[0].Path, Equals, "/app/db")
+		c.Assert(problems[0].Fixed, Equals, true)
+
+		exists, err = s.Exists(testRoot + "fsck/app/db/~dir~")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, true)
+
+		problems, err = b.Fsck(nil, true)
+		c.Assert(err, IsNil)
+		c.Assert(len(problems), Equals, 1)
+		c.Assert(problems[0].Fixed, Equals, true)
+
+		problems, err = b.Fsck(nil, false)
+		c.Assert(err, IsNil)
+		c.Assert(len(problems), Equals, 0)
+	}
+}
@@ -0,0 +1,67 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	. "gopkg.in/check.v1"
+	"path"
+	"testing"
+)
+
+func TestQuota(t *testing.T) { TestingT(t) }
+
+type TestSuiteQuota struct {
+	testStores
+}
+
+var _ = Suite(&TestSuiteQuota{})
+
+func (suite *TestSuiteQuota) SetUpSuite(c *C) {
+	suite.setUp(c, "quota")
+	for _, s := range suite.stores {
+		s.Put(testRoot+"quota/~dir~", []byte(""), nil)
+		s.Put(testRoot+"quota/team/~dir~", []byte(""), nil)
+		s.Put(testRoot+"quota/team/a", []byte("1234"), nil)
+		s.Put(testRoot+"quota/team/sub/~dir~", []byte(""), nil)
+		s.Put(testRoot+"quota/team/sub/b", []byte("123456"), nil)
+	}
+}
+
+func (suite *TestSuiteQuota) TearDownSuite(c *C) {
+	suite.tearDown(c)
+}
+
+func (suite *TestSuiteQuota) TestQuota(c *C) {
+	for _, url := range kvstores() {
+		u := url.String() + "/" + path.Join(testRoot, "quota")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+
+		q, err := b.Quota([]string{"team"})
+		c.Assert(err, IsNil)
+		c.Assert(q, IsNil)
+
+		err = b.SetQuota([]string{"team"}, &kvfs.Quota{MaxBytes: 100, MaxEntries: 10})
+		c.Assert(err, IsNil)
+
+		q, err = b.Quota([]string{"team"})
+		c.Assert(err, IsNil)
+		c.Assert(*q, Equals, kvfs.Quota{MaxBytes: 100, MaxEntries: 10})
+
+		// The quota itself is not counted or listed.
+		usage, err := b.Usage([]string{"team"})
+		c.Assert(err, IsNil)
+		c.Assert(*usage, Equals, kvfs.Usage{Keys: 2, Dirs: 1, Bytes: 10})
+
+		names := []string{}
+		for entry := range b.Context(nil).Dir([]string{"team"}).Cursor() {
+			names = append(names, entry.Key)
+		}
+		c.Assert(len(names), Equals, 2)
+
+		err = b.DeleteQuota([]string{"team"})
+		c.Assert(err, IsNil)
+		q, err = b.Quota([]string{"team"})
+		c.Assert(err, IsNil)
+		c.Assert(q, IsNil)
+	}
+}
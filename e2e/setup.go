@@ -1,8 +1,12 @@
 package e2e
 
 import (
+	"github.com/conductant/kvfs"
+	"github.com/docker/libkv/store"
+	. "gopkg.in/check.v1"
 	net "net/url"
 	"os"
+	"strings"
 )
 
 func zkUrl() string {
@@ -36,3 +40,30 @@ func kvstores() []*net.URL {
 	}
 	return urls
 }
+
+// testStores are the kv stores of a suite, in the order of kvstores, whose keys are all below
+// the directory dir of testRoot.
+type testStores struct {
+	dir      string
+	stores   []store.Store
+	handlers []*kvfs.Handler
+}
+
+func (this *testStores) setUp(c *C, dir string) {
+	this.dir = dir
+	for _, url := range kvstores() {
+		s, h, err := kvfs.GetStore(url, nil)
+		c.Assert(err, IsNil)
+		this.stores = append(this.stores, s)
+		this.handlers = append(this.handlers, h)
+	}
+}
+
+// tearDown deletes the directory of the suite in every store.
+func (this *testStores) tearDown(c *C) {
+	for i, s := range this.stores {
+		d := kvfs.NewDirLike(s, strings.Split(testRoot, "/"), this.handlers[i])
+		err := d.DeleteDir(this.dir)
+		c.Log(this.dir, ">>>>", err)
+	}
+}
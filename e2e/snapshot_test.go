@@ -0,0 +1,93 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	. "gopkg.in/check.v1"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) { TestingT(t) }
+
+type TestSuiteSnapshot struct {
+	testStores
+}
+
+var _ = Suite(&TestSuiteSnapshot{})
+
+func (suite *TestSuiteSnapshot) SetUpSuite(c *C) {
+	suite.setUp(c, "snapshot")
+	for _, s := range suite.stores {
+		s.Put(testRoot+"snapshot/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"snapshot/app/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"snapshot/app/port", []byte("8080"), nil)
+		s.Put(testRoot+"snapshot/app/db/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"snapshot/app/db/host", []byte("db1"), nil)
+	}
+}
+
+func (suite *TestSuiteSnapshot) TearDownSuite(c *C) {
+	suite.tearDown(c)
+}
+
+func (suite *TestSuiteSnapshot) TestSnapshot(c *C) {
+	for i, url := range kvstores() {
+		s := suite.stores[i]
+		app := testRoot + "snapshot/app/"
+		u := url.String() + "/" + path.Join(testRoot, "snapshot")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+
+		m, err := b.CreateSnapshot("before", []string{"app"})
+		c.Assert(err, IsNil)
+		c.Assert(m.Keys, Equals, 2)
+		c.Assert(m.Dirs, Equals, 1)
+
+		_, err = b.CreateSnapshot("before", []string{"app"})
+		c.Assert(err, NotNil)
+
+		list, err := b.Snapshots()
+		c.Assert(err, IsNil)
+		c.Assert(len(list), Equals, 1)
+		c.Assert(list[0].Path, Equals, "/app")
+
+		// The system directory is not listed.
+		for entry := range b.Context(nil).Dir([]string{}).Cursor() {
+			c.Assert(entry.Key, Equals, "app")
+		}
+
+		s.Put(app+"port", []byte("9090"), nil)
+		s.Put(app+"extra", []byte("x"), nil)
+		kvfs.NewDirLike(s, strings.Split(strings.Trim(app, "/"), "/"), suite.handlers[i]).DeleteDir("db")
+
+		changes, err := b.RestoreSnapshot("before", true)
+		c.Assert(err, IsNil)
+		c.Assert(len(changes), Equals, 4)
+		kv, err := s.Get(app + "port")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "9090")
+
+		changes, err = b.RestoreSnapshot("before", false)
+		c.Assert(err, IsNil)
+		c.Assert(len(changes), Equals, 4)
+		kv, err = s.Get(app + "port")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "8080")
+		kv, err = s.Get(app + "db/host")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "db1")
+		exists, err := s.Exists(app + "extra")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, false)
+
+		changes, err = b.RestoreSnapshot("before", false)
+		c.Assert(err, IsNil)
+		c.Assert(len(changes), Equals, 0)
+
+		c.Assert(b.DeleteSnapshot("before"), IsNil)
+		list, err = b.Snapshots()
+		c.Assert(err, IsNil)
+		c.Assert(len(list), Equals, 0)
+	}
+}
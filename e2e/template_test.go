@@ -0,0 +1,61 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	"github.com/docker/libkv/store"
+	. "gopkg.in/check.v1"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) { TestingT(t) }
+
+type TestSuiteTemplate struct {
+	stores   []store.Store
+	handlers []*kvfs.Handler
+}
+
+var _ = Suite(&TestSuiteTemplate{})
+
+func (suite *TestSuiteTemplate) SetUpSuite(c *C) {
+
+	for _, url := range kvstores() {
+		b, h, err := kvfs.GetStore(url, nil)
+		c.Assert(err, IsNil)
+		suite.stores = append(suite.stores, b)
+		suite.handlers = append(suite.handlers, h)
+	}
+
+	for _, s := range suite.stores {
+		s.Put(testRoot+"tmpl/~dir~", []byte(""), nil)
+		s.Put(testRoot+"tmpl/app/~dir~", []byte(""), nil)
+		s.Put(testRoot+"tmpl/app/host", []byte("localhost"), nil)
+		s.Put(testRoot+"tmpl/app/port", []byte("8080"), nil)
+		s.Put(testRoot+"tmpl/nginx.conf.tmpl",
+			[]byte(`listen {{get "/app/port"}}; server {{get "app/host"}}; {{range ls "/app"}}[{{.}}]{{end}}`), nil)
+	}
+}
+
+func (suite *TestSuiteTemplate) TearDownSuite(c *C) {
+	for i, s := range suite.stores {
+		d := kvfs.NewDirLike(s, strings.Split(testRoot, "/"), suite.handlers[i])
+		err := d.DeleteDir("tmpl")
+		c.Log("3>>>>", err)
+	}
+}
+
+func (suite *TestSuiteTemplate) TestRender(c *C) {
+	for _, url := range kvstores() {
+		u := url.String() + "/" + path.Join(testRoot, "tmpl")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+
+		out, err := kvfs.Render(b.Context(nil), []string{}, "nginx.conf.tmpl")
+		c.Assert(err, IsNil)
+		c.Assert(string(out), Equals, "listen 8080; server localhost; [host][port]")
+
+		_, err = kvfs.Render(b.Context(nil), []string{}, "missing.tmpl")
+		c.Assert(err, Not(IsNil))
+	}
+}
@@ -0,0 +1,83 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	. "gopkg.in/check.v1"
+	"path"
+	"testing"
+)
+
+func TestTrash(t *testing.T) { TestingT(t) }
+
+type TestSuiteTrash struct {
+	testStores
+}
+
+var _ = Suite(&TestSuiteTrash{})
+
+func (suite *TestSuiteTrash) SetUpSuite(c *C) {
+	suite.setUp(c, "trash")
+	for _, s := range suite.stores {
+		s.Put(testRoot+"trash/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"trash/app/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"trash/app/port", []byte("8080"), nil)
+		s.Put(testRoot+"trash/app/db/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"trash/app/db/host", []byte("db1"), nil)
+	}
+}
+
+func (suite *TestSuiteTrash) TearDownSuite(c *C) {
+	suite.tearDown(c)
+}
+
+func (suite *TestSuiteTrash) TestTrash(c *C) {
+	for i, url := range kvstores() {
+		s := suite.stores[i]
+		app := testRoot + "trash/app/"
+		u := url.String() + "/" + path.Join(testRoot, "trash")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+
+		c.Assert(b.SetQuota([]string{"app", "db"}, &kvfs.Quota{MaxEntries: 10}), IsNil)
+
+		file, err := b.Trash([]string{"app", "port"}, 0)
+		c.Assert(err, IsNil)
+		c.Assert(file.Bytes, Equals, 4)
+		dir, err := b.Trash([]string{"app", "db"}, 0)
+		c.Assert(err, IsNil)
+		c.Assert(dir.Dir, Equals, true)
+		c.Assert(dir.Keys, Equals, 1)
+
+		exists, err := s.Exists(app + "port")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, false)
+
+		entries, err := b.TrashEntries()
+		c.Assert(err, IsNil)
+		c.Assert(len(entries), Equals, 2)
+		c.Assert(entries[0].Path, Equals, "/app/port")
+
+		_, err = b.RestoreTrash(dir.Id)
+		c.Assert(err, IsNil)
+		kv, err := s.Get(app + "db/host")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "db1")
+		q, err := b.Quota([]string{"app", "db"})
+		c.Assert(err, IsNil)
+		c.Assert(q, NotNil)
+		c.Assert(q.MaxEntries, Equals, uint64(10))
+
+		// Something else was created at the path since.
+		s.Put(app+"port", []byte("9090"), nil)
+		_, err = b.RestoreTrash(file.Id)
+		_, is := err.(*kvfs.ErrConflict)
+		c.Assert(is, Equals, true)
+
+		purged, err := b.PurgeTrash(0, 1)
+		c.Assert(err, IsNil)
+		c.Assert(len(purged), Equals, 1)
+		entries, err = b.TrashEntries()
+		c.Assert(err, IsNil)
+		c.Assert(len(entries), Equals, 0)
+	}
+}
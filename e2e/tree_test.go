@@ -0,0 +1,118 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	. "gopkg.in/check.v1"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTree(t *testing.T) { TestingT(t) }
+
+type TestSuiteTree struct {
+	testStores
+}
+
+var _ = Suite(&TestSuiteTree{})
+
+func (suite *TestSuiteTree) SetUpSuite(c *C) {
+	suite.setUp(c, "tree")
+	for _, s := range suite.stores {
+		s.Put(testRoot+"tree/~dir~", []byte{1}, nil)
+		// a mounted tree, with its system directory
+		s.Put(testRoot+"tree/mounted/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"tree/mounted/~kvfs~/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"tree/mounted/~kvfs~/trash/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"tree/mounted/app/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"tree/mounted/app/db/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"tree/mounted/app/db/host", []byte("db1"), nil)
+		// a tree that's not mounted
+		s.Put(testRoot+"tree/plain/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"tree/plain/host", []byte("db2"), nil)
+	}
+}
+
+func (suite *TestSuiteTree) TearDownSuite(c *C) {
+	suite.tearDown(c)
+}
+
+func (suite *TestSuiteTree) TestOpenPath(c *C) {
+	top := strings.Split(strings.Trim(testRoot, "/"), "/")
+	under := func(elem ...string) []string {
+		return append(append([]string{}, top...), elem...)
+	}
+	for i, url := range kvstores() {
+		base := url.String() + "/" + path.Join(testRoot, "tree")
+		for _, t := range []struct {
+			url, root string
+			wantRoot  []string
+			wantPath  []string
+		}{
+			// the closest parent with a system directory
+			{base + "/mounted/app/db/host", "", under("tree", "mounted"), []string{"app", "db", "host"}},
+			{base + "/mounted/app", "", under("tree", "mounted"), []string{"app"}},
+			// only the parents of the path are searched
+			{base + "/mounted", "", []string{""}, under("tree", "mounted")},
+			// no system directory above
+			{base + "/plain/host", "", []string{""}, under("tree", "plain", "host")},
+			// the given root
+			{base + "/mounted/app/db", "/" + path.Join(testRoot, "tree"), under("tree"), []string{"mounted", "app", "db"}},
+			{base + "/plain/host", path.Join(testRoot, "tree", "plain"), under("tree", "plain"), []string{"host"}},
+		} {
+			b, p, err := kvfs.OpenPath(t.url, t.root, nil)
+			c.Assert(err, IsNil, Commentf(t.url))
+			c.Assert(b.Root, DeepEquals, t.wantRoot, Commentf(t.url))
+			c.Assert(p, DeepEquals, t.wantPath, Commentf(t.url))
+		}
+
+		// The trash of the root is the one of the mount.
+		b, p, err := kvfs.OpenPath(base+"/mounted/app/db/host", "", nil)
+		c.Assert(err, IsNil)
+		_, err = b.Trash(p, 0)
+		c.Assert(err, IsNil)
+		_, err = suite.stores[i].Get(testRoot + "tree/mounted/app/db/host")
+		c.Assert(err, NotNil)
+		entries, err := b.TrashEntries()
+		c.Assert(err, IsNil)
+		c.Assert(len(entries), Equals, 1)
+
+		_, _, err = kvfs.OpenPath(base+"/mounted/app", path.Join(testRoot, "tree", "plain"), nil)
+		c.Assert(err, ErrorMatches, ".* is not below the root .*")
+	}
+}
+
+func (suite *TestSuiteTree) TestMkdirAll(c *C) {
+	for i, url := range kvstores() {
+		s := suite.stores[i]
+		b, err := kvfs.NewBackend(url.String()+"/"+path.Join(testRoot, "tree", "plain"), nil)
+		c.Assert(err, IsNil)
+
+		c.Assert(b.MkdirAll([]string{"a", "b", "c"}), IsNil)
+		for _, dir := range [][]string{{"a"}, {"a", "b"}, {"a", "b", "c"}} {
+			stat, err := b.Context(nil).StrictDir(dir[:len(dir)-1]).Stat(dir[len(dir)-1])
+			c.Assert(err, IsNil, Commentf("%v", dir))
+			c.Assert(stat.Dir, Equals, true, Commentf("%v", dir))
+		}
+		// existing directories are kept
+		c.Assert(b.MkdirAll([]string{"a", "b"}), IsNil)
+
+		// The quota of a holds b, b/c and one more entry.
+		c.Assert(b.SetQuota([]string{"a"}, &kvfs.Quota{MaxEntries: 3}), IsNil)
+		err = b.MkdirAll([]string{"a", "x", "y", "z"})
+		c.Assert(err, FitsTypeOf, &kvfs.ErrQuotaExceeded{})
+		_, err = s.Get(testRoot + "tree/plain/a/x/~dir~")
+		c.Assert(err, IsNil)
+		_, err = s.Get(testRoot + "tree/plain/a/x/y/~dir~")
+		c.Assert(err, NotNil)
+
+		// the same checks as the mount before writing a file
+		c.Assert(b.CheckEntries([]string{"a", "x"}), FitsTypeOf, &kvfs.ErrQuotaExceeded{})
+		c.Assert(b.CheckEntries([]string{}), IsNil)
+		c.Assert(b.SetQuota([]string{"a"}, &kvfs.Quota{MaxBytes: 10, MaxFileSize: 4}), IsNil)
+		c.Assert(b.CheckWrite([]string{"a", "b"}, 4, 4), IsNil)
+		c.Assert(b.CheckWrite([]string{"a", "b"}, 5, 5), FitsTypeOf, &kvfs.ErrFileTooLarge{})
+		c.Assert(b.CheckWrite([]string{"a", "b"}, 4, 11), FitsTypeOf, &kvfs.ErrQuotaExceeded{})
+		c.Assert(b.DeleteQuota([]string{"a"}), IsNil)
+	}
+}
@@ -0,0 +1,89 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	. "gopkg.in/check.v1"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestUnion(t *testing.T) { TestingT(t) }
+
+type TestSuiteUnion struct {
+	testStores
+}
+
+var _ = Suite(&TestSuiteUnion{})
+
+func (suite *TestSuiteUnion) SetUpSuite(c *C) {
+	suite.setUp(c, "union")
+	for _, s := range suite.stores {
+		s.Put(testRoot+"union/defaults/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"union/defaults/port", []byte("8080"), nil)
+		s.Put(testRoot+"union/defaults/host", []byte("localhost"), nil)
+		s.Put(testRoot+"union/defaults/db/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"union/defaults/db/host", []byte("db1"), nil)
+		s.Put(testRoot+"union/env/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"union/env/port", []byte("9090"), nil)
+		s.Put(testRoot+"union/env/db/~dir~", []byte{1}, nil)
+		s.Put(testRoot+"union/env/db/user", []byte("app"), nil)
+	}
+}
+
+func (suite *TestSuiteUnion) TearDownSuite(c *C) {
+	suite.tearDown(c)
+}
+
+func (suite *TestSuiteUnion) TestUnion(c *C) {
+	for i, url := range kvstores() {
+		s := suite.stores[i]
+		urls := []string{
+			url.String() + "/" + path.Join(testRoot, "union", "env"),
+			url.String() + "/" + path.Join(testRoot, "union", "defaults"),
+		}
+		b, err := kvfs.NewUnionBackend(urls, nil)
+		c.Assert(err, IsNil)
+		ctx := b.Context(nil)
+
+		// Lookups resolve top-down.
+		c.Assert(string(ctx.Dir([]string{}).Get("port")), Equals, "9090")
+		c.Assert(string(ctx.Dir([]string{}).Get("host")), Equals, "localhost")
+
+		list := func() []string {
+			names := []string{}
+			for entry := range ctx.Dir([]string{}).Cursor() {
+				names = append(names, entry.Key)
+			}
+			sort.Strings(names)
+			return names
+		}
+		c.Assert(list(), DeepEquals, []string{"db", "host", "port"})
+
+		// Writes go to the top layer.
+		c.Assert(ctx.Dir([]string{}).Put("host", []byte("example.com")), IsNil)
+		kv, err := s.Get(testRoot + "union/env/host")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "example.com")
+		kv, err = s.Get(testRoot + "union/defaults/host")
+		c.Assert(err, IsNil)
+		c.Assert(string(kv.Value), Equals, "localhost")
+
+		// Deleting a lower entry leaves a whiteout in the top layer.
+		c.Assert(ctx.Dir([]string{}).DeleteDir("db"), IsNil)
+		c.Assert(list(), DeepEquals, []string{"host", "port"})
+		exists, err := s.Exists(testRoot + "union/env/" + kvfs.WhiteoutPrefix + "db")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, true)
+		exists, err = s.Exists(testRoot + "union/defaults/db/host")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, true)
+		// The copy in the top layer is gone, and no whiteouts were left for the entries below it.
+		exists, err = s.Exists(testRoot + "union/env/db/user")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, false)
+		exists, err = s.Exists(testRoot + "union/env/db/" + kvfs.WhiteoutPrefix + "host")
+		c.Assert(err, IsNil)
+		c.Assert(exists, Equals, false)
+	}
+}
@@ -0,0 +1,73 @@
+package e2e
+
+import (
+	"github.com/conductant/kvfs"
+	"github.com/docker/libkv/store"
+	. "gopkg.in/check.v1"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) { TestingT(t) }
+
+type TestSuiteWatch struct {
+	stores   []store.Store
+	handlers []*kvfs.Handler
+}
+
+var _ = Suite(&TestSuiteWatch{})
+
+func (suite *TestSuiteWatch) SetUpSuite(c *C) {
+
+	for _, url := range kvstores() {
+		b, h, err := kvfs.GetStore(url, nil)
+		c.Assert(err, IsNil)
+		suite.stores = append(suite.stores, b)
+		suite.handlers = append(suite.handlers, h)
+	}
+
+	for _, s := range suite.stores {
+		s.Put(testRoot+"watch/~dir~", []byte(""), nil)
+		s.Put(testRoot+"watch/a", []byte("a"), nil)
+	}
+}
+
+func (suite *TestSuiteWatch) TearDownSuite(c *C) {
+	for i, s := range suite.stores {
+		d := kvfs.NewDirLike(s, strings.Split(testRoot, "/"), suite.handlers[i])
+		err := d.DeleteDir("watch")
+		c.Log("4>>>>", err)
+	}
+}
+
+func (suite *TestSuiteWatch) TestChanges(c *C) {
+	for i, url := range kvstores() {
+		u := url.String() + "/" + path.Join(testRoot, "watch")
+		b, err := kvfs.NewBackend(u, nil)
+		c.Assert(err, IsNil)
+
+		stop := make(chan struct{})
+		changes, err := b.Changes([]string{}, stop)
+		c.Assert(err, IsNil)
+
+		suite.stores[i].Put(testRoot+"watch/b", []byte("b"), nil)
+
+		select {
+		case batch := <-changes:
+			c.Log("changes=", batch)
+			found := false
+			for _, change := range batch {
+				if change.Key == "/b" {
+					c.Assert(change.Op, Equals, kvfs.OpPut)
+					found = true
+				}
+			}
+			c.Assert(found, Equals, true)
+		case <-time.After(10 * time.Second):
+			c.Fatal("timed out waiting for change")
+		}
+		close(stop)
+	}
+}
@@ -15,3 +15,90 @@ type ErrNotSupported struct {
 func (this *ErrNotSupported) Error() string {
 	return "Protocol not supported:" + this.Protocol
 }
+
+type ErrTemplateKey struct {
+	Key string
+}
+
+func (this *ErrTemplateKey) Error() string {
+	return "Template key not found:" + this.Key
+}
+
+// ErrBackendUnavailable is returned when the kv store can't be reached, after any retries.  FailFast is set
+// if the call wasn't attempted because the circuit breaker is open.
+type ErrBackendUnavailable struct {
+	Cause    error
+	FailFast bool
+}
+
+func (this *ErrBackendUnavailable) Error() string {
+	if this.Cause == nil {
+		return "Backend unavailable"
+	}
+	return "Backend unavailable:" + this.Cause.Error()
+}
+
+type ErrNotFound struct {
+	Key string
+}
+
+func (this *ErrNotFound) Error() string {
+	return "Not found:" + this.Key
+}
+
+type ErrNotDir struct {
+	Key string
+}
+
+func (this *ErrNotDir) Error() string {
+	return "Not a directory:" + this.Key
+}
+
+// ErrQuotaExceeded is returned when a write would take the directory Path over its quota.
+type ErrQuotaExceeded struct {
+	Path  string
+	Limit string
+}
+
+func (this *ErrQuotaExceeded) Error() string {
+	return "Quota exceeded:" + this.Path + " " + this.Limit
+}
+
+// ErrFileTooLarge is returned when a value would be larger than the max file size of a quota.
+type ErrFileTooLarge struct {
+	Path string
+}
+
+func (this *ErrFileTooLarge) Error() string {
+	return "File too large for quota:" + this.Path
+}
+
+// ErrConflict is returned when a compare-and-swap write fails because the key was changed since it
+// was read.
+type ErrConflict struct {
+	Key string
+}
+
+func (this *ErrConflict) Error() string {
+	return "Changed since read:" + this.Key
+}
+
+// ErrFailedUnmount is returned when the mount can't be unmounted, with the reason given by the system.
+type ErrFailedUnmount struct {
+	Mountpoint string
+	Reason     string
+}
+
+func (this *ErrFailedUnmount) Error() string {
+	return "Failed to unmount " + this.Mountpoint + ": " + this.Reason
+}
+
+// ErrJournalInUse is returned when the journal directory is locked by another open journal, e.g. of
+// another mount.
+type ErrJournalInUse struct {
+	Dir string
+}
+
+func (this *ErrJournalInUse) Error() string {
+	return "Journal in use:" + this.Dir
+}
@@ -0,0 +1,170 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Number of events kept for readers that fall behind.  A reader that falls further behind
+	// than this skips ahead to the oldest event still kept.
+	eventsBacklog = 1024
+)
+
+// eventHub watches the tree under the mount root and keeps the recent changes in a ring buffer.
+// Each reader of the events file has its own cursor into the buffer.
+type eventHub struct {
+	db   *Backend
+	stop <-chan struct{}
+
+	// held while starting the watch, which reads the whole tree
+	startMu sync.Mutex
+	started bool
+
+	mu     sync.Mutex
+	ring   []*Change
+	next   uint64 // sequence number of the next event
+	notify chan struct{}
+}
+
+func newEventHub(db *Backend, stop <-chan struct{}) *eventHub {
+	return &eventHub{
+		db:     db,
+		stop:   stop,
+		ring:   make([]*Change, eventsBacklog),
+		notify: make(chan struct{}),
+	}
+}
+
+// start watches the backend on first use, so mounts that nobody tails don't pay for the watch.
+// If starting fails, it's tried again by the next open.  Once started, Changes retries the watch
+// itself until the file system is stopped.
+func (h *eventHub) start() error {
+	h.startMu.Lock()
+	defer h.startMu.Unlock()
+
+	if h.started {
+		return nil
+	}
+	changes, err := h.db.Changes(nil, h.stop)
+	if err != nil {
+		return err
+	}
+	h.started = true
+	go func() {
+		for batch := range changes {
+			h.publish(batch)
+		}
+	}()
+	return nil
+}
+
+func (h *eventHub) publish(batch []*Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, c := range batch {
+		h.ring[h.next%eventsBacklog] = c
+		h.next++
+	}
+	close(h.notify)
+	h.notify = make(chan struct{})
+}
+
+// read blocks until there are events after cursor and returns them with the new cursor.
+func (h *eventHub) read(c context.Context, cursor uint64) ([]*Change, uint64, error) {
+	for {
+		h.mu.Lock()
+		if cursor < h.next {
+			if h.next-cursor > eventsBacklog {
+				cursor = h.next - eventsBacklog
+			}
+			out := []*Change{}
+			for ; cursor < h.next; cursor++ {
+				out = append(out, h.ring[cursor%eventsBacklog])
+			}
+			h.mu.Unlock()
+			return out, cursor, nil
+		}
+		notify := h.notify
+		h.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-c.Done():
+			return nil, cursor, fuse.EINTR
+		}
+	}
+}
+
+// EventsFile streams newline delimited json change events.  Reads block until there are new events.
+type EventsFile struct {
+	hub *eventHub
+}
+
+var _ = fs.Node(&EventsFile{})
+
+func (f *EventsFile) Attr(c context.Context, a *fuse.Attr) error {
+	a.Mode = 0444
+	return nil
+}
+
+var _ = fs.NodeOpener(&EventsFile{})
+
+func (f *EventsFile) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	if err := f.hub.start(); err != nil {
+		return nil, err
+	}
+	// Bypass the page cache so every read reaches us regardless of the file size.
+	resp.Flags |= fuse.OpenDirectIO | fuse.OpenNonSeekable
+
+	f.hub.mu.Lock()
+	defer f.hub.mu.Unlock()
+	return &eventsHandle{hub: f.hub, cursor: f.hub.next}, nil
+}
+
+// eventsHandle is one reader of the events file.  Readers start at the events that happen after open.
+type eventsHandle struct {
+	hub *eventHub
+
+	mu     sync.Mutex
+	cursor uint64
+	// encoded events not yet returned because they didn't fit in the last read
+	buff []byte
+}
+
+var _ = fs.HandleReader(&eventsHandle{})
+
+func (h *eventsHandle) Read(c context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.buff) == 0 {
+		events, cursor, err := h.hub.read(c, h.cursor)
+		if err != nil {
+			return err
+		}
+		h.cursor = cursor
+		for _, e := range events {
+			line, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			h.buff = append(append(h.buff, line...), '\n')
+		}
+	}
+	n := req.Size
+	if n > len(h.buff) {
+		n = len(h.buff)
+	}
+	resp.Data = append(resp.Data[:0], h.buff[:n]...)
+	h.buff = h.buff[n:]
+	return nil
+}
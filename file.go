@@ -1,49 +1,105 @@
 package kvfs
 
 import (
+	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"bazil.org/fuse/fuseutil"
+	"github.com/docker/libkv/store"
 	"golang.org/x/net/context"
 )
 
 type File struct {
 	dir  *Dir
 	name string
+	// set if it's the value of the directory name, see DirValues
+	dirValue bool
 
 	mu sync.Mutex
 	// number of write-capable handles currently open
 	writers uint
 	// only valid if writers > 0
 	data []byte
+	// what data was loaded from, for compare-and-swap and the write-back journal: BaseIndex
+	// (the value at index), BaseNew or BaseAny
+	base  string
+	index uint64
+	// size of the value in the kv store, for quotas
+	stored int
+	// set if data changed since it was loaded or stored
+	dirty bool
+	// bytes written since data was stored, for write-through
+	unstored int
 }
 
 var _ = fs.Node(&File{})
 var _ = fs.Handle(&File{})
 
+// key returns the backend key of the file.
+func (f *File) key() string {
+	return f.dir.key(f.name)
+}
+
 // load calls fn inside a View with the contents of the file. Caller
 // must make a copy of the data if needed, because once we're out of
 // the transaction, bolt might reuse the db page.
+//
+// Writes still pending in the write-back journal take precedence over the kv store, then values
+// in the read cache.  If the kv store is unreachable, a stale cached value may be served.
 func (f *File) load(c context.Context, fn func([]byte)) error {
-	err := f.dir.fs.db.View(c, func(ctx Context) error {
-		b := ctx.Dir(f.dir.path)
-		v := b.Get(f.name)
-		if v == nil {
-			return fuse.ESTALE
+	key := f.key()
+	if j := f.dir.fs.journal; j != nil {
+		if v, pending := j.Get(key); pending {
+			f.base, f.index, f.stored = BaseAny, 0, len(v)
+			fn(v)
+			return nil
 		}
-		fn(v)
+	}
+	cache := f.dir.fs.cache
+	if kv, hit := cache.get(key); hit {
+		f.base, f.index, f.stored = BaseIndex, kv.LastIndex, len(kv.Value)
+		fn(kv.Value)
 		return nil
+	}
+
+	var kv *store.KVPair
+	err := f.dir.fs.db.View(c, func(ctx Context) (err error) {
+		kv, err = ctx.StrictDir(f.dir.path).GetPair(f.name)
+		return err
 	})
-	return err
+	switch err.(type) {
+	case nil:
+		cache.put(key, kv)
+	case *ErrNotFound:
+		return fuse.ESTALE
+	case *ErrBackendUnavailable:
+		stale, has := cache.stale(key)
+		if !has {
+			return errno(err)
+		}
+		kv = stale
+	default:
+		return errno(err)
+	}
+	f.base, f.index, f.stored = BaseIndex, kv.LastIndex, len(kv.Value)
+	fn(kv.Value)
+	return nil
 }
 
-func (f *File) Attr(c context.Context, a *fuse.Attr) error {
+func (f *File) Attr(c context.Context, a *fuse.Attr) (err error) {
+	defer f.dir.fs.stats.fuseOp("Attr", time.Now(), &err)
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	a.Inode = inode(f.key())
+	if f.dirValue {
+		a.Inode = dirValueInode(f.key())
+	}
 	a.Mode = 0644
 	a.Size = uint64(len(f.data))
 	if f.writers == 0 {
@@ -54,9 +110,18 @@ func (f *File) Attr(c context.Context, a *fuse.Attr) error {
 	return nil
 }
 
+var _ = fs.NodeForgetter(&File{})
+
+func (f *File) Forget() {
+	f.dir.fs.forget(f.key(), f)
+}
+
 var _ = fs.NodeOpener(&File{})
 
-func (f *File) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+func (f *File) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer f.dir.fs.stats.fuseOp("Open", time.Now(), &err)
+	defer func() { f.dir.fs.audit.read("Open", &req.Header, f.key(), 0, err) }()
+
 	if req.Flags.IsReadOnly() {
 		// we don't need to track read-only handles
 		return f, nil
@@ -73,6 +138,7 @@ func (f *File) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenRes
 		if err := f.load(c, fn); err != nil {
 			return nil, err
 		}
+		f.dirty, f.unstored = false, 0
 	}
 
 	f.writers++
@@ -81,7 +147,9 @@ func (f *File) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenRes
 
 var _ = fs.HandleReleaser(&File{})
 
-func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer f.dir.fs.stats.fuseOp("Release", time.Now(), &err)
+
 	if req.Flags.IsReadOnly() {
 		// we don't need to track read-only handles
 		return nil
@@ -93,13 +161,17 @@ func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	f.writers--
 	if f.writers == 0 {
 		f.data = nil
+		f.dirty = false
 	}
 	return nil
 }
 
 var _ = fs.HandleReader(&File{})
 
-func (f *File) Read(c context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+func (f *File) Read(c context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer f.dir.fs.stats.fuseOp("Read", time.Now(), &err)
+	defer func() { f.dir.fs.audit.read("Read", &req.Header, f.key(), int64(len(resp.Data)), err) }()
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -107,10 +179,9 @@ func (f *File) Read(c context.Context, req *fuse.ReadRequest, resp *fuse.ReadRes
 		fuseutil.HandleRead(req, resp, b)
 	}
 	if f.writers == 0 {
-		f.load(c, fn)
-	} else {
-		fn(f.data)
+		return f.load(c, fn)
 	}
+	fn(f.data)
 	return nil
 }
 
@@ -118,7 +189,9 @@ var _ = fs.HandleWriter(&File{})
 
 const maxInt = int(^uint(0) >> 1)
 
-func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer f.dir.fs.stats.fuseOp("Write", time.Now(), &err)
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -127,18 +200,36 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 	if newLen > int64(maxInt) {
 		return fuse.Errno(syscall.EFBIG)
 	}
+	if newLen > int64(len(f.data)) {
+		if err := f.dir.fs.quotas.checkSize(f.dir.path, uint64(newLen)); err != nil {
+			return errno(err)
+		}
+	}
 	if newLen := int(newLen); newLen > len(f.data) {
 		f.data = append(f.data, make([]byte, newLen-len(f.data))...)
 	}
 
 	n := copy(f.data[req.Offset:], req.Data)
 	resp.Size = n
+	f.dirty = true
+	f.unstored += n
+
+	if threshold := f.dir.fs.writeThrough; threshold > 0 && f.unstored >= threshold {
+		size := int64(len(f.data))
+		err = f.persist(ctx, req.Uid)
+		f.dir.fs.audit.sized("Write", &req.Header, f.key(), size, err)
+		if err != nil {
+			return errno(err)
+		}
+	}
 	return nil
 }
 
 var _ = fs.HandleFlusher(&File{})
 
-func (f *File) Flush(c context.Context, req *fuse.FlushRequest) error {
+func (f *File) Flush(c context.Context, req *fuse.FlushRequest) (err error) {
+	defer f.dir.fs.stats.fuseOp("Flush", time.Now(), &err)
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -148,19 +239,126 @@ func (f *File) Flush(c context.Context, req *fuse.FlushRequest) error {
 		return nil
 	}
 
+	if !f.dirty {
+		return nil
+	}
+	err = f.persist(c, req.Uid)
+	f.dir.fs.audit.sized("Flush", &req.Header, f.key(), int64(len(f.data)), err)
+	return errno(err)
+}
+
+var _ = fs.NodeFsyncer(&File{})
+
+// Fsync writes the data of the open handles to the kv store, if it changed.  When it returns
+// without error the value is in the kv store, or in the write-back journal on local disk if the
+// kv store is unreachable.
+func (f *File) Fsync(c context.Context, req *fuse.FsyncRequest) (err error) {
+	defer f.dir.fs.stats.fuseOp("Fsync", time.Now(), &err)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.writers == 0 || !f.dirty {
+		return nil
+	}
+	err = f.persist(c, req.Uid)
+	f.dir.fs.audit.sized("Fsync", &req.Header, f.key(), int64(len(f.data)), err)
+	return errno(err)
+}
+
+// persist stores the data within the quotas.  Caller must hold mu.
+func (f *File) persist(c context.Context, uid uint32) error {
+	delta := int64(len(f.data) - f.stored)
+	if err := f.dir.fs.quotas.checkBytes(f.dir.path, delta); err != nil {
+		return err
+	}
+	if err := f.store(c, uid); err != nil {
+		return err
+	}
+	f.dir.fs.quotas.charge(f.dir.path, 0, 0, delta)
+	f.stored = len(f.data)
+	f.dirty = false
+	f.unstored = 0
+	return nil
+}
+
+// store writes the data to the kv store.  In cas mode, the write fails with *ErrConflict if the key
+// was changed since it was loaded or last stored.  With the write-back journal enabled, a write
+// that fails because the kv store is unreachable is appended to the journal instead, and so is
+// every write while the journal isn't empty, to keep the order of writes.  In history mode the
+// value it replaces is added to the history once the write succeeded, except for writes to the
+// journal.
+func (f *File) store(c context.Context, uid uint32) error {
+	defer f.dir.fs.cache.invalidate(f.key())
+	j := f.dir.fs.journal
+	if j != nil && j.Len() > 0 {
+		return j.Append(f.key(), f.data, f.base, f.index)
+	}
 	err := f.dir.fs.db.Update(c, func(ctx Context) error {
-		b := ctx.Dir(f.dir.path)
-		return b.Put(f.name, f.data)
+		b := ctx.StrictDir(f.dir.path)
+		limit := f.dir.fs.history
+		var prev *store.KVPair
+		if limit > 0 {
+			kv, err := b.GetPair(f.name)
+			if _, is := err.(*ErrNotFound); err != nil && !is {
+				return err
+			}
+			prev = kv
+		}
+		if err := f.put(b); err != nil {
+			return err
+		}
+		if prev == nil {
+			return nil
+		}
+		return f.dir.fs.db.recordHistory(relPath(filepath.Join(f.dir.path...), f.name), prev, uid, limit)
 	})
-	if err != nil {
+	if _, is := err.(*ErrBackendUnavailable); is && j != nil {
+		return j.Append(f.key(), f.data, f.base, f.index)
+	}
+	return err
+}
+
+// put writes the data to the key, checking the base of the write in cas mode.
+func (f *File) put(b StrictDirLike) error {
+	if f.dir.fs.cas && f.base != BaseAny {
+		var previous *store.KVPair
+		if f.base == BaseIndex {
+			previous = &store.KVPair{Key: f.key(), LastIndex: f.index}
+		}
+		kv, err := b.AtomicPut(f.name, f.data, previous)
+		if err != nil {
+			return err
+		}
+		f.base, f.index = BaseIndex, kv.LastIndex
+		return nil
+	}
+	if err := b.Put(f.name, f.data); err != nil {
 		return err
 	}
+	if f.dir.fs.journal == nil && !f.dir.fs.cas {
+		return nil
+	}
+	// Later writes of this handle are based on this one.
+	f.base = BaseAny
+	if kv, err := b.GetPair(f.name); err == nil {
+		f.base, f.index = BaseIndex, kv.LastIndex
+	}
 	return nil
 }
 
 var _ = fs.NodeSetattrer(&File{})
 
-func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer f.dir.fs.stats.fuseOp("Setattr", time.Now(), &err)
+	defer func() {
+		if req.Valid.Size() {
+			f.dir.fs.audit.sized("Setattr", &req.Header, f.key(), int64(req.Size), err)
+		} else {
+			f.dir.fs.audit.op("Setattr", &req.Header, f.key(), &err)
+		}
+	}()
+
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -168,6 +366,9 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 		if req.Size > uint64(maxInt) {
 			return fuse.Errno(syscall.EFBIG)
 		}
+		if err := f.dir.fs.quotas.checkSize(f.dir.path, req.Size); err != nil {
+			return errno(err)
+		}
 		newLen := int(req.Size)
 		switch {
 		case newLen > len(f.data):
@@ -175,6 +376,7 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 		case newLen < len(f.data):
 			f.data = f.data[:newLen]
 		}
+		f.dirty = true
 	}
 	return nil
 }
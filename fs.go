@@ -1,11 +1,129 @@
 package kvfs
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"bazil.org/fuse/fs"
 )
 
 type FS struct {
 	db *Backend
+
+	// nil if templates are not enabled
+	templates *templates
+	events    *eventHub
+	stats     *Stats
+	// nil if auditing is not enabled
+	audit *Audit
+	// nil if the read cache is not enabled
+	cache *readCache
+	// nil if the write-back journal is not enabled
+	journal *Journal
+
+	quotas        *quotas
+	statfs        usageCache
+	capacityBytes uint64
+	capacityKeys  uint64
+	storeUsage    bool
+	cas           bool
+	writeThrough  int
+	history       int
+	trash         bool
+	// "", DirValuesInside or DirValuesSibling
+	dirValues string
+	// purge limits of the trash
+	trashRetention time.Duration
+	trashMaxBytes  uint64
+
+	// closed when the file system is unmounted, to stop the background work
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu sync.Mutex
+	// nodes by backend key
+	nodes map[string]fs.Node
+}
+
+// NewFS returns the file system of db, which it closes when stopped.
+func NewFS(db *Backend, config *Config) (_ *FS, err error) {
+	f := &FS{
+		db:     db,
+		stats:  db.Stats,
+		quotas: newQuotas(db),
+		nodes:  map[string]fs.Node{},
+		stop:   make(chan struct{}),
+	}
+	f.events = newEventHub(db, f.stop)
+	if config == nil {
+		return f, nil
+	}
+	f.capacityBytes = config.CapacityBytes
+	f.capacityKeys = config.CapacityKeys
+	f.storeUsage = config.StoreUsage
+	f.cas = config.CAS
+	f.writeThrough = config.WriteThrough
+	f.history = config.History
+	if err := checkDirValues(config.DirValues); err != nil {
+		return nil, err
+	}
+	f.dirValues = config.DirValues
+	if config.Templates {
+		f.templates = &templates{fs: f, renderers: map[string]*renderer{}}
+	}
+	audit, err := NewAudit(config.AuditLog, config.AuditReads)
+	if err != nil {
+		return nil, err
+	}
+	f.audit = audit
+	defer func() {
+		if err != nil {
+			f.audit.Close()
+		}
+	}()
+	if config.CacheDir != "" && config.CacheSize <= 0 {
+		return nil, fmt.Errorf("cache_dir needs a cache_size")
+	}
+	if config.CacheSize > 0 {
+		cache, err := newReadCache(db, config.CacheSize, config.CacheDir, config.ServeStale)
+		if err != nil {
+			return nil, err
+		}
+		f.cache = cache
+	}
+	if config.JournalDir != "" {
+		journal, err := OpenJournal(config.JournalDir, db)
+		if err != nil {
+			return nil, err
+		}
+		f.journal = journal
+	}
+	if config.Trash {
+		f.trash = true
+		f.trashRetention = config.TrashRetention
+		f.trashMaxBytes = config.TrashMaxBytes
+		go f.purgeTrash()
+	}
+	return f, nil
+}
+
+// Stop stops the background work of the file system, e.g. purging the trash, the watches of the
+// read cache and templates, and replaying the journal, and closes the audit log and the kv store.
+// It's called when the file system is unmounted.
+func (f *FS) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+		if f.templates != nil {
+			f.templates.flush()
+		}
+		f.cache.close()
+		if f.journal != nil {
+			f.journal.Close()
+		}
+		f.audit.Close()
+		f.db.store.Close()
+	})
 }
 
 var _ = fs.FS(&FS{})
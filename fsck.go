@@ -0,0 +1,196 @@
+package kvfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/docker/libkv/store"
+)
+
+// The kinds of problems found by Fsck.
+const (
+	// A directory without a ~dir~ marker, e.g. written by another tool.  It's listed as a
+	// directory only as long as it has entries.
+	FsckMissingMarker = "missing_marker"
+	// A marker left behind by a directory that was deleted, or a marker with entries below it.
+	FsckOrphanMarker = "orphan_marker"
+	// A key with a value and entries below it.  The mount shows it as a directory, and the value
+	// only with dir_values set.
+	FsckCollision = "collision"
+	// A name that can't be a file name, e.g. empty, . or .., or longer than 255 bytes.
+	FsckIllegalName = "illegal_name"
+	// An etcd record with no value and nothing below it: an empty directory made by another tool,
+	// which the mount lists as a file that can't be written, or an empty value.
+	FsckZeroByte = "zero_byte"
+)
+
+// FsckProblem is an inconsistency found by Fsck.
+type FsckProblem struct {
+	Kind string `json:"kind"`
+	// Path below the root, e.g. /app/db
+	Path   string `json:"path"`
+	Detail string `json:"detail"`
+	// What fixing does, or empty if it can't be fixed and needs a look
+	Fix   string `json:"fix,omitempty"`
+	Fixed bool   `json:"fixed"`
+	// Why fixing failed
+	Error string `json:"error,omitempty"`
+}
+
+// illegalName returns why the name can't be a file name, or "" if it can.
+func illegalName(name string) string {
+	switch {
+	case name == "":
+		return "empty name"
+	case name == "." || name == "..":
+		return "reserved file name " + name
+	case len(name) > maxNameLen:
+		return fmt.Sprintf("name longer than %d bytes", maxNameLen)
+	case strings.ContainsRune(name, 0):
+		return "name with a NUL byte"
+	}
+	return ""
+}
+
+// Fsck walks the subtree at path below the root and checks that directories have their markers,
+// that markers belong to a directory, and that every key can be shown by the mount.  With fix,
+// the problems that can be fixed without losing data are: missing markers are written, orphan
+// markers deleted, and empty etcd directories given a marker.  Collisions and illegal names are
+// only reported.
+func (this *Backend) Fsck(path []string, fix bool) ([]*FsckProblem, error) {
+	p := filepath.Join(append(append([]string{}, this.Root...), path...)...)
+	prefix := strings.Trim(p, "/")
+
+	keys := map[string]*store.KVPair{}
+	// names of the entries of each directory, by path below p
+	dirs := map[string]map[string]bool{}
+	err := this.walk(p, func(child string, kv *store.KVPair) {
+		// Not cleaned, so empty names, e.g. a//b in consul, are kept.
+		rel := strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(child, "/"), prefix), "/")
+		keys[rel] = kv
+		// consul has no keys for the directories above a key
+		for rel != "" {
+			dir, name := "", rel
+			if i := strings.LastIndex(rel, "/"); i >= 0 {
+				dir, name = rel[:i], rel[i+1:]
+			}
+			if dirs[dir] == nil {
+				dirs[dir] = map[string]bool{}
+			}
+			dirs[dir][name] = true
+			rel = dir
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []*FsckProblem{}
+	report := func(kind, rel, detail, fixDesc string, fixFn func() (bool, error)) {
+		problem := &FsckProblem{
+			Kind:   kind,
+			Path:   "/" + strings.Trim(filepath.Join(append(append([]string{}, path...), rel)...), "/"),
+			Detail: detail,
+			Fix:    fixDesc,
+		}
+		if fix && fixFn != nil {
+			fixed, err := fixFn()
+			if err != nil {
+				problem.Error = err.Error()
+			}
+			problem.Fixed = fixed
+		}
+		problems = append(problems, problem)
+	}
+	key := func(rel ...string) string {
+		return filepath.Join(append([]string{p}, rel...)...)
+	}
+
+	for dir, names := range dirs {
+		for name := range names {
+			if reason := illegalName(name); reason != "" {
+				report(FsckIllegalName, filepath.Join(dir, name), reason, "", nil)
+			}
+		}
+		// The root of the backend has no marker, and its value is the one written by NewBackend.
+		if dir == "" && len(path) == 0 {
+			continue
+		}
+		if IsMarker(filepath.Base(dir)) {
+			report(FsckOrphanMarker, dir, "reserved name with entries below it", "", nil)
+			continue
+		}
+		if kv := keys[dir]; kv != nil && len(kv.Value) > 0 {
+			report(FsckCollision, dir, fmt.Sprintf("key with a value of %d bytes and entries below it", len(kv.Value)), "", nil)
+		}
+		entries := 0
+		for name := range names {
+			if !IsMarker(name) {
+				entries++
+			}
+		}
+		switch {
+		case names[DirMarker]:
+		case entries > 0:
+			report(FsckMissingMarker, dir, "directory without a "+DirMarker+" marker", "write the marker",
+				func() (bool, error) {
+					err := this.store.Put(key(dir, DirMarker), []byte{1}, nil) // etcd won't write zero byte records
+					return err == nil, err
+				})
+		case names[QuotaMarker]:
+			rel := filepath.Join(dir, QuotaMarker)
+			report(FsckOrphanMarker, rel, "quota of a directory that was deleted", "delete the marker",
+				func() (bool, error) {
+					if err := this.store.Delete(key(rel)); err != nil {
+						return false, err
+					}
+					if len(names) == 1 {
+						// best effort, like DeleteDir, so zk and etcd don't keep an empty node
+						this.Handler.DeleteEmptyParent(this.store, key(dir))
+					}
+					return true, nil
+				})
+		}
+	}
+
+	if this.Url.Scheme == "etcd" {
+		for rel, kv := range keys {
+			if rel == "" || len(kv.Value) > 0 || dirs[rel] != nil || IsMarker(filepath.Base(rel)) {
+				continue
+			}
+			rel := rel
+			report(FsckZeroByte, rel, "record with no value: an empty directory, or an empty value",
+				"write a "+DirMarker+" marker if it's a directory",
+				func() (bool, error) {
+					err := this.store.Put(key(rel, DirMarker), []byte{1}, nil)
+					if notDir(err) {
+						// etcd refuses keys below a value, which is then kept as an empty file.
+						return false, nil
+					}
+					return err == nil, err
+				})
+		}
+	}
+	sort.Sort(fsckProblems(problems))
+	return problems, nil
+}
+
+// notDir returns true if etcd refused a key below a key that has a value.
+func notDir(err error) bool {
+	e, is := err.(etcd.Error)
+	return is && e.Code == etcd.ErrorCodeNotDir
+}
+
+type fsckProblems []*FsckProblem
+
+func (l fsckProblems) Len() int { return len(l) }
+func (l fsckProblems) Less(i, j int) bool {
+	if l[i].Path == l[j].Path {
+		return l[i].Kind < l[j].Kind
+	}
+	return l[i].Path < l[j].Path
+}
+func (l fsckProblems) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
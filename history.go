@@ -0,0 +1,125 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+// Suffix of the directory of the history of a file in the history tree, e.g.
+// history/app/config.yaml@history/42 is the value of app/config.yaml at index 42.
+const HistorySuffix = "@history"
+
+// HistoryRecord is a previous value of a key.
+type HistoryRecord struct {
+	// LastIndex of the value
+	Index uint64 `json:"index"`
+	// When the value was replaced, and by whom
+	Time  time.Time `json:"time"`
+	Uid   uint32    `json:"uid"`
+	Value []byte    `json:"value"`
+}
+
+// historyDir returns the key of the directory of the history of the key at path below the root.
+func (this *Backend) historyDir(path []string) string {
+	p := this.systemPath(append([]string{"history"}, path...)...)
+	return filepath.Join(p...) + HistorySuffix
+}
+
+// recordHistory saves the value of the key at path before it's replaced, and drops the oldest
+// values beyond limit.
+func (this *Backend) recordHistory(path []string, prev *store.KVPair, uid uint32, limit int) error {
+	buff, err := json.Marshal(&HistoryRecord{
+		Index: prev.LastIndex,
+		Time:  time.Now(),
+		Uid:   uid,
+		Value: prev.Value,
+	})
+	if err != nil {
+		return err
+	}
+	dir := this.historyDir(path)
+	if err := this.store.Put(dir+"/"+strconv.FormatUint(prev.LastIndex, 10), buff, nil); err != nil {
+		return err
+	}
+	records, err := this.History(path)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(records)-limit; i++ {
+		if err := this.store.Delete(dir + "/" + strconv.FormatUint(records[i].Index, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History returns the previous values of the key at path below the root, oldest first.
+func (this *Backend) History(path []string) ([]*HistoryRecord, error) {
+	dir := this.historyDir(path)
+	list, err := this.store.List(dir)
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := []*HistoryRecord{}
+	for _, kv := range list {
+		if _, err := strconv.ParseUint(this.Handler.NameFromKey(dir, kv.Key), 10, 64); err != nil {
+			continue
+		}
+		r := &HistoryRecord{}
+		if err := json.Unmarshal(kv.Value, r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Sort(historyByIndex(records))
+	return records, nil
+}
+
+// Revert writes back the value the key at path below the root had at index.  The value it replaces
+// is added to the history.
+func (this *Backend) Revert(path []string, index uint64, uid uint32, limit int) error {
+	dir := this.historyDir(path)
+	kv, err := this.store.Get(dir + "/" + strconv.FormatUint(index, 10))
+	if err == store.ErrKeyNotFound {
+		return &ErrNotFound{dir + "/" + strconv.FormatUint(index, 10)}
+	}
+	if err != nil {
+		return err
+	}
+	r := &HistoryRecord{}
+	if err := json.Unmarshal(kv.Value, r); err != nil {
+		return err
+	}
+	key := filepath.Join(append(append([]string{}, this.Root...), path...)...)
+	if prev, err := this.store.Get(key); err == nil {
+		if err := this.recordHistory(path, prev, uid, limit); err != nil {
+			return err
+		}
+	} else if err != store.ErrKeyNotFound {
+		return err
+	}
+	return this.store.Put(key, r.Value, nil)
+}
+
+type historyByIndex []*HistoryRecord
+
+func (l historyByIndex) Len() int           { return len(l) }
+func (l historyByIndex) Less(i, j int) bool { return l[i].Index < l[j].Index }
+func (l historyByIndex) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// historyValue is the content of the files of the history tree: the value of the record.
+func historyValue(buff []byte) []byte {
+	r := &HistoryRecord{}
+	if err := json.Unmarshal(buff, r); err != nil {
+		return nil
+	}
+	return r.Value
+}
@@ -0,0 +1,82 @@
+package kvfs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"bazil.org/fuse/fs"
+)
+
+// Inode of the root of the mount.
+const rootInode = 1
+
+// inode returns the inode number of a backend key.  It's a hash of the key, so a key has the same
+// inode across lookups and mounts.
+func inode(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	i := h.Sum64()
+	if i <= rootInode {
+		i += rootInode + 1
+	}
+	return i
+}
+
+var _ = fs.FSInodeGenerator(&FS{})
+
+// GenerateInode picks inodes for the nodes that don't have one of their own, like the control
+// directory, from the parent inode and the name.
+func (f *FS) GenerateInode(parent uint64, name string) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], parent)
+	h.Write(buf[:])
+	h.Write([]byte(name))
+	i := h.Sum64()
+	if i <= rootInode {
+		i += rootInode + 1
+	}
+	return i
+}
+
+// node returns the node serving the key, or the one returned by create if there is none yet or it
+// is of another kind, e.g. a file that was replaced by a directory.  Serving a key with the same
+// node keeps the state of open files in one place.
+func (f *FS) node(key string, dir bool, create func() fs.Node) fs.Node {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if n, has := f.nodes[key]; has {
+		if _, isDir := n.(*Dir); isDir == dir {
+			return n
+		}
+	}
+	n := create()
+	f.nodes[key] = n
+	return n
+}
+
+// setNode makes n the node serving the key, e.g. a file that was just created.
+func (f *FS) setNode(key string, n fs.Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[key] = n
+}
+
+// forget drops the node serving the key, if it's still n.
+func (f *FS) forget(key string, n fs.Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.nodes[key] == n {
+		delete(f.nodes, key)
+	}
+}
+
+// dropNode drops the node serving the key, e.g. when the key is removed, so a new key by the same
+// name gets a new node.
+func (f *FS) dropNode(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.nodes, key)
+}
@@ -0,0 +1,441 @@
+package kvfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+const (
+	journalFile   = "journal"
+	conflictsFile = "conflicts"
+	// flock'd by the open journal, so two mounts don't replay the same entries
+	lockFile = "lock"
+
+	// How often to try to replay the journal while the kv store is unreachable.
+	journalRetry = 5 * time.Second
+)
+
+// What a write is based on, to check on replay that the key wasn't changed by someone else.
+const (
+	// The value at a LastIndex
+	BaseIndex = "index"
+	// The key didn't exist
+	BaseNew = "new"
+	// The version isn't known and the write isn't checked
+	BaseAny = "any"
+	// The previous entry of the same key in the journal
+	BaseFollows = "follows"
+)
+
+// JournalEntry is a flush that couldn't be written to the kv store.
+type JournalEntry struct {
+	Seq uint64 `json:"seq"`
+	// Backend key, including the root
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Size  int    `json:"size"`
+	// What the write was based on: BaseIndex (the value at Index), BaseNew, BaseAny, or
+	// BaseFollows for the previous entry of the same key in the journal.
+	Base  string    `json:"base"`
+	Index uint64    `json:"index,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// JournalConflict is an entry that wasn't replayed because the key was changed by someone else
+// in the meantime.  The value is kept so it can be recovered by hand.
+type JournalConflict struct {
+	JournalEntry
+	CurrentIndex uint64    `json:"current_index"`
+	Replayed     time.Time `json:"replayed"`
+}
+
+// Journal is an on-disk write-back journal.  Flushes that fail because the kv store is unreachable
+// are appended to it and fsync'd, and are replayed in order once the kv store is back.  A write is
+// replayed with CAS against the LastIndex it was based on; if the key was changed in the meantime
+// the entry is recorded as a conflict instead.
+type Journal struct {
+	dir  string
+	db   *Backend
+	lock *os.File
+
+	// held by Replay, which doesn't hold mu while it calls the kv store
+	replaying sync.Mutex
+
+	mu      sync.Mutex
+	entries []*JournalEntry
+	seq     uint64
+	wake    chan struct{}
+
+	// closed by Close, to stop replaying
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenJournal opens or creates the journal in dir and starts replaying any pending entries.  The
+// directory is locked until Close.
+func OpenJournal(dir string, db *Backend) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &ErrJournalInUse{dir}
+		}
+		return nil, err
+	}
+	entries, err := ReadJournal(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	j := &Journal{
+		dir:     dir,
+		db:      db,
+		lock:    lock,
+		entries: entries,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	if len(entries) > 0 {
+		j.seq = entries[len(entries)-1].Seq
+	}
+	go j.replayLoop()
+	return j, nil
+}
+
+// ReadJournal returns the pending entries of the journal in dir.
+func ReadJournal(dir string) ([]*JournalEntry, error) {
+	f, err := os.Open(filepath.Join(dir, journalFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*JournalEntry{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		e := &JournalEntry{}
+		err := dec.Decode(e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A torn write at the end from a crash in the middle of an append; it was never acknowledged.
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ReadJournalConflicts returns the entries that were not replayed because of conflicts.
+func ReadJournalConflicts(dir string) ([]*JournalConflict, error) {
+	f, err := os.Open(filepath.Join(dir, conflictsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conflicts := []*JournalConflict{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		c := &JournalConflict{}
+		if err := dec.Decode(c); err != nil {
+			break
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, nil
+}
+
+// JournalStatus lists the pending entries and the conflicts of a journal, without the values.
+type JournalStatus struct {
+	Dir       string             `json:"dir"`
+	Pending   []*JournalEntry    `json:"pending"`
+	Conflicts []*JournalConflict `json:"conflicts"`
+}
+
+// ReadJournalStatus returns the status of the journal in dir.  It works whether or not the journal
+// is in use by a mount.
+func ReadJournalStatus(dir string) (*JournalStatus, error) {
+	pending, err := ReadJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+	conflicts, err := ReadJournalConflicts(dir)
+	if err != nil {
+		return nil, err
+	}
+	status := &JournalStatus{Dir: dir, Pending: []*JournalEntry{}, Conflicts: []*JournalConflict{}}
+	for _, e := range pending {
+		e.Value = nil
+		status.Pending = append(status.Pending, e)
+	}
+	for _, c := range conflicts {
+		c.Value = nil
+		status.Conflicts = append(status.Conflicts, c)
+	}
+	return status, nil
+}
+
+// Status returns the status of the journal.
+func (j *Journal) Status() (*JournalStatus, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return ReadJournalStatus(j.dir)
+}
+
+// Len returns the number of pending entries.
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.entries)
+}
+
+// Get returns the latest pending value of the key, so reads see the writes not yet replayed.
+func (j *Journal) Get(key string) ([]byte, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		if j.entries[i].Key == key {
+			return j.entries[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns the names of the keys with pending writes directly below the key dir.
+func (j *Journal) Names(dir string) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	dir = filepath.Clean(dir) // "." for the top of the kv store
+	names := []string{}
+	seen := map[string]bool{}
+	for _, e := range j.entries {
+		if name := filepath.Base(e.Key); filepath.Dir(e.Key) == dir && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Append durably records a write based on the given version of the key.  When it returns without
+// error the write is safe to acknowledge.
+func (j *Journal) Append(key string, value []byte, base string, index uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e := &JournalEntry{
+		Seq:   j.seq + 1,
+		Key:   key,
+		Value: append([]byte(nil), value...),
+		Size:  len(value),
+		Base:  base,
+		Index: index,
+		Time:  time.Now(),
+	}
+	for _, prev := range j.entries {
+		if prev.Key == key {
+			e.Base = BaseFollows
+			e.Index = 0
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(j.dir, journalFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	j.seq = e.Seq
+	j.entries = append(j.entries, e)
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops replaying, waiting for a replay in progress, and unlocks the directory.  The pending
+// entries stay in the journal for the next OpenJournal.
+func (j *Journal) Close() (err error) {
+	j.closeOnce.Do(func() {
+		close(j.stop)
+		j.replaying.Lock()
+		defer j.replaying.Unlock()
+		err = j.lock.Close()
+	})
+	return err
+}
+
+func (j *Journal) replayLoop() {
+	for {
+		select {
+		case <-j.wake:
+		case <-time.After(journalRetry):
+		case <-j.stop:
+			return
+		}
+		j.Replay()
+	}
+}
+
+// Replay writes the pending entries to the kv store in order.  It stops at the first entry that
+// fails because the kv store is unreachable.  Reads and appends aren't blocked while it waits on
+// the kv store: the entry being replayed stays pending until it's written.
+func (j *Journal) Replay() error {
+	j.replaying.Lock()
+	defer j.replaying.Unlock()
+
+	select {
+	case <-j.stop:
+		// closed, and maybe already opened again by another mount
+		return nil
+	default:
+	}
+
+	// LastIndex of the keys written by this replay, for the entries that follow them.
+	written := map[string]*store.KVPair{}
+	conflicted := map[string]bool{}
+	for {
+		j.mu.Lock()
+		if len(j.entries) == 0 {
+			j.mu.Unlock()
+			return nil
+		}
+		e := j.entries[0]
+		j.mu.Unlock()
+
+		current, err := j.db.store.Get(e.Key)
+		if err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+		if err == store.ErrKeyNotFound {
+			current = nil
+		}
+
+		var previous *store.KVPair
+		conflict := false
+		switch {
+		case e.Base == BaseFollows && conflicted[e.Key]:
+			conflict = true
+		case e.Base == BaseFollows && written[e.Key] != nil:
+			previous = written[e.Key]
+		case e.Base == BaseNew:
+			// A new key, unless someone else created it in the meantime.
+			conflict = current != nil
+		case e.Base == BaseIndex:
+			conflict = current == nil || current.LastIndex != e.Index
+			previous = current
+		default:
+			// Not checked, or the entry it follows was replayed in an earlier run.  Write on top
+			// of whatever is there.
+			previous = current
+		}
+
+		if !conflict {
+			ok, kv, err := j.db.store.AtomicPut(e.Key, e.Value, previous, nil)
+			switch {
+			case err == store.ErrKeyModified || err == store.ErrKeyExists || (err == nil && !ok):
+				conflict = true
+			case err != nil:
+				return err
+			default:
+				written[e.Key] = kv
+			}
+		}
+		var c *JournalConflict
+		if conflict {
+			conflicted[e.Key] = true
+			c = &JournalConflict{JournalEntry: *e, Replayed: time.Now()}
+			if current != nil {
+				c.CurrentIndex = current.LastIndex
+			}
+		}
+		if err := j.pop(c); err != nil {
+			return err
+		}
+	}
+}
+
+// pop removes the entry at the head, which was replayed or is the conflict c if not nil.  Only
+// Replay removes entries, so the head is still the entry it replayed.
+func (j *Journal) pop(c *JournalConflict) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if c != nil {
+		if err := j.appendConflict(c); err != nil {
+			return err
+		}
+	}
+	if err := j.rewrite(j.entries[1:]); err != nil {
+		return err
+	}
+	j.entries = j.entries[1:]
+	return nil
+}
+
+func (j *Journal) appendConflict(c *JournalConflict) error {
+	f, err := os.OpenFile(filepath.Join(j.dir, conflictsFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(c); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// rewrite atomically replaces the journal with the given entries.
+func (j *Journal) rewrite(entries []*JournalEntry) error {
+	tmp := filepath.Join(j.dir, journalFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(j.dir, journalFile))
+}
@@ -0,0 +1,25 @@
+package kvfs
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TestSuiteJournal struct{}
+
+var _ = Suite(&TestSuiteJournal{})
+
+func (suite *TestSuiteJournal) TestLock(c *C) {
+	dir := c.MkDir()
+	// Nothing is pending, so the kv store isn't used.
+	j, err := OpenJournal(dir, nil)
+	c.Assert(err, IsNil)
+
+	_, err = OpenJournal(dir, nil)
+	c.Assert(err, FitsTypeOf, &ErrJournalInUse{})
+
+	c.Assert(j.Close(), IsNil)
+	c.Assert(j.Close(), IsNil)
+	again, err := OpenJournal(dir, nil)
+	c.Assert(err, IsNil)
+	c.Assert(again.Close(), IsNil)
+}
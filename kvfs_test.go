@@ -0,0 +1,9 @@
+package kvfs
+
+import (
+	. "gopkg.in/check.v1"
+	"testing"
+)
+
+// Test runs the gocheck suites of the package.
+func Test(t *testing.T) { TestingT(t) }
@@ -0,0 +1,102 @@
+package kvfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// WriteMetrics writes the stats of the backends in the prometheus text exposition format.
+// The series are labeled with the scheme of the backend.
+func WriteMetrics(w io.Writer, backends ...*Backend) error {
+	out := bufio.NewWriter(w)
+	snapshots := []*StatsSnapshot{}
+	for _, b := range backends {
+		snapshots = append(snapshots, b.Stats.Snapshot())
+	}
+
+	ops := func(kind, what string, get func(*StatsSnapshot) map[string]OpStats) {
+		fmt.Fprintf(out, "# HELP kvfs_%s_ops_total Number of %s.\n", kind, what)
+		fmt.Fprintf(out, "# TYPE kvfs_%s_ops_total counter\n", kind)
+		for i, s := range snapshots {
+			m := get(s)
+			for _, op := range sortedKeys(m) {
+				fmt.Fprintf(out, "kvfs_%s_ops_total{backend=%q,op=%q} %d\n", kind, backends[i].Url.Scheme, op, m[op].Count)
+			}
+		}
+		fmt.Fprintf(out, "# HELP kvfs_%s_errors_total Number of %s that failed.\n", kind, what)
+		fmt.Fprintf(out, "# TYPE kvfs_%s_errors_total counter\n", kind)
+		for i, s := range snapshots {
+			m := get(s)
+			for _, op := range sortedKeys(m) {
+				fmt.Fprintf(out, "kvfs_%s_errors_total{backend=%q,op=%q} %d\n", kind, backends[i].Url.Scheme, op, m[op].Errors)
+			}
+		}
+		fmt.Fprintf(out, "# HELP kvfs_%s_duration_seconds Latency of %s.\n", kind, what)
+		fmt.Fprintf(out, "# TYPE kvfs_%s_duration_seconds histogram\n", kind)
+		for i, s := range snapshots {
+			m := get(s)
+			for _, op := range sortedKeys(m) {
+				labels := fmt.Sprintf("backend=%q,op=%q", backends[i].Url.Scheme, op)
+				cumulative := uint64(0)
+				for b, le := range LatencyBuckets {
+					cumulative += m[op].Buckets[b]
+					fmt.Fprintf(out, "kvfs_%s_duration_seconds_bucket{%s,le=\"%s\"} %d\n", kind, labels,
+						strconv.FormatFloat(le.Seconds(), 'g', -1, 64), cumulative)
+				}
+				fmt.Fprintf(out, "kvfs_%s_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", kind, labels, m[op].Count)
+				fmt.Fprintf(out, "kvfs_%s_duration_seconds_sum{%s} %s\n", kind, labels,
+					strconv.FormatFloat(m[op].Total.Seconds(), 'g', -1, 64))
+				fmt.Fprintf(out, "kvfs_%s_duration_seconds_count{%s} %d\n", kind, labels, m[op].Count)
+			}
+		}
+	}
+	ops("fuse", "fuse operations served", func(s *StatsSnapshot) map[string]OpStats { return s.Fuse })
+	ops("store", "calls made to the kv store", func(s *StatsSnapshot) map[string]OpStats { return s.Store })
+
+	counter := func(name, help string, get func(*StatsSnapshot) uint64) {
+		fmt.Fprintf(out, "# HELP kvfs_%s %s\n", name, help)
+		fmt.Fprintf(out, "# TYPE kvfs_%s counter\n", name)
+		for i, s := range snapshots {
+			fmt.Fprintf(out, "kvfs_%s{backend=%q} %d\n", name, backends[i].Url.Scheme, get(s))
+		}
+	}
+	counter("cache_hits_total", "Reads served from the local cache.", func(s *StatsSnapshot) uint64 { return s.CacheHits })
+	counter("cache_misses_total", "Reads that missed the local cache.", func(s *StatsSnapshot) uint64 { return s.CacheMisses })
+	counter("stale_reads_total", "Reads served from the local cache because the kv store failed.", func(s *StatsSnapshot) uint64 { return s.StaleReads })
+	return out.Flush()
+}
+
+func sortedKeys(m map[string]OpStats) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetricsHandler serves the stats of the backends to prometheus.
+func MetricsHandler(backends ...*Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, backends...)
+	})
+}
+
+// ServeMetrics listens on addr and serves the metrics at /metrics.  Close the returned listener
+// to stop.
+func ServeMetrics(addr string, backends ...*Backend) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(backends...))
+	go http.Serve(l, mux)
+	return l, nil
+}
@@ -4,25 +4,50 @@ import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type handle struct {
 	io.Closer
 
-	conn *fuse.Conn
+	conn    *fuse.Conn
+	fs      *FS
+	metrics net.Listener
+	// closed when the file system is unmounted
+	done chan struct{}
+}
+
+// Done is closed when the file system is unmounted, e.g. by kvfs unmount.
+func (this *handle) Done() <-chan struct{} {
+	return this.done
 }
 
 func (this *handle) Close() error {
+	if this.fs != nil {
+		this.fs.Stop()
+	}
+	if this.metrics != nil {
+		this.metrics.Close()
+	}
 	if this.conn != nil {
 		return this.conn.Close()
 	}
 	return nil
 }
 
-// Mount does not block.  It's up to the caller to block by reading on a channel, etc.
+// Mount does not block once the file system is mounted.  It's up to the caller to block by
+// reading on a channel, etc.
 func Mount(url, mountpoint string, config *Config) (io.Closer, error) {
-	db, err := NewBackend(url, config)
+	return MountUnion([]string{url}, mountpoint, config)
+}
+
+// MountUnion mounts the union of the urls, top first.  See NewUnionBackend.
+func MountUnion(urls []string, mountpoint string, config *Config) (io.Closer, error) {
+	db, err := NewUnionBackend(urls, config)
 	if err != nil {
 		return nil, err
 	}
@@ -30,20 +55,79 @@ func Mount(url, mountpoint string, config *Config) (io.Closer, error) {
 	var perm os.FileMode = 0644
 
 	if err := os.MkdirAll(mountpoint, perm); err != nil {
+		db.store.Close()
 		return nil, err
 	}
 
-	c, err := fuse.Mount(mountpoint)
+	filesystem, err := NewFS(db, config)
+	if err != nil {
+		db.store.Close()
+		return nil, err
+	}
+
+	h := &handle{fs: filesystem, done: make(chan struct{})}
+	if config != nil && config.MetricsAddr != "" {
+		if h.metrics, err = ServeMetrics(config.MetricsAddr, db); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+
+	// Shows in /proc/mounts as fuse.kvfs, with the url.  Commas separate mount options.
+	options := []fuse.MountOption{
+		fuse.FSName(strings.Replace(db.String(), ",", ";", -1)),
+		fuse.Subtype("kvfs"),
+	}
+	if config != nil && config.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if config != nil && config.ReadOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(mountpoint, options...)
 	if err != nil {
+		h.Close()
 		return nil, err
 	}
+	h.conn = c
 
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		mountpoint = abs
+	}
 	go func() {
-		fs.Serve(c, &FS{
-			db: db,
-		})
+		fs.Serve(c, filesystem)
+		filesystem.Stop()
+		control.remove(mountpoint)
+		close(h.done)
 	}()
-	return &handle{conn: c}, nil
+
+	<-c.Ready
+	if err := c.MountError; err != nil {
+		h.Close()
+		return nil, err
+	}
+	control.add(mountpoint, filesystem)
+	return h, nil
+}
+
+// WaitReachable waits for at most timeout until the kv store at url answers.
+func WaitReachable(url string, config *Config, timeout time.Duration) error {
+	db, err := NewBackend(url, config)
+	if err != nil {
+		return err
+	}
+	defer db.store.Close()
+	deadline := time.Now().Add(timeout)
+	for wait := 100 * time.Millisecond; ; wait = wait * 2 {
+		err := db.Ping()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		if wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+		time.Sleep(wait)
+	}
 }
 
 func Unmount(mountpoint string) error {
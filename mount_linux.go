@@ -0,0 +1,70 @@
+package kvfs
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// UnmountWith unmounts like Unmount, or lazily, detaching the mount now and cleaning up once it's
+// no longer busy, or by force, even if the process serving it doesn't answer.
+func UnmountWith(mountpoint string, lazy, force bool) error {
+	if !lazy && !force {
+		return Unmount(mountpoint)
+	}
+	flags := 0
+	if lazy {
+		flags |= syscall.MNT_DETACH
+	}
+	if force {
+		flags |= syscall.MNT_FORCE
+	}
+	err := syscall.Unmount(mountpoint, flags)
+	if err == nil || !lazy {
+		return err
+	}
+	// Users other than root can only unmount lazily with fusermount.
+	if out, ferr := exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput(); ferr != nil {
+		return &ErrFailedUnmount{mountpoint, strings.TrimSpace(string(out))}
+	}
+	return nil
+}
+
+// SystemMounts returns the kvfs mounts listed in /proc/mounts.
+func SystemMounts() ([]*SystemMount, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := []*SystemMount{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != "fuse.kvfs" {
+			continue
+		}
+		out = append(out, &SystemMount{Source: unescapeMount(fields[0]), Mountpoint: unescapeMount(fields[1])})
+	}
+	return out, scanner.Err()
+}
+
+// unescapeMount undoes the octal escapes of spaces, tabs, etc. in /proc/mounts.
+func unescapeMount(s string) string {
+	out := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(n))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
@@ -0,0 +1,31 @@
+package kvfs
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TestSuiteMountLinux struct{}
+
+var _ = Suite(&TestSuiteMountLinux{})
+
+func (suite *TestSuiteMountLinux) TestUnescapeMount(c *C) {
+	for _, t := range []struct {
+		in, want string
+	}{
+		{"/mnt/app", "/mnt/app"},
+		{"", ""},
+		{`/mnt/my\040app`, "/mnt/my app"},
+		{`/mnt/a\011b\012c`, "/mnt/a\tb\nc"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`/mnt/app\040`, "/mnt/app "},
+		{`\040`, " "},
+		// not escapes: too short, not octal, or above a byte
+		{`/mnt/app\04`, `/mnt/app\04`},
+		{`/mnt/app\`, `/mnt/app\`},
+		{`/mnt/a\089`, `/mnt/a\089`},
+		{`/mnt/a\777`, `/mnt/a\777`},
+		{`zk://host:2181/app`, "zk://host:2181/app"},
+	} {
+		c.Assert(unescapeMount(t.in), Equals, t.want, Commentf(t.in))
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package kvfs
+
+import (
+	"fmt"
+)
+
+// UnmountWith unmounts like Unmount.  Lazy and forced unmounts are only supported on linux.
+func UnmountWith(mountpoint string, lazy, force bool) error {
+	if lazy || force {
+		return fmt.Errorf("Lazy and forced unmounts are only supported on linux")
+	}
+	return Unmount(mountpoint)
+}
+
+// SystemMounts returns nothing; only linux lists the mounts in /proc/mounts.  The mounts are
+// still found through their control sockets.
+func SystemMounts() ([]*SystemMount, error) {
+	return nil, nil
+}
@@ -0,0 +1,269 @@
+package kvfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	net "net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MountSpec is a mount of a mounts file.  Options are the flags of Config by name, e.g.
+// cache_size, cert or store_retries.
+type MountSpec struct {
+	Mountpoint string `yaml:"mountpoint"`
+	Url        string `yaml:"url"`
+	// urls of the lower layers of a union, top first
+	Lower   []string          `yaml:"lower,omitempty"`
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+// MountsFile lists the mounts managed by one process, e.g.
+//
+//	mounts:
+//	- mountpoint: /mnt/app
+//	  url: zk://localhost:2181/app
+//	  options:
+//	    cache_size: 1000
+//	    cert: /etc/kvfs/cert.pem
+type MountsFile struct {
+	Mounts []*MountSpec `yaml:"mounts"`
+}
+
+// ReadMountsFile reads and checks a mounts file.
+func ReadMountsFile(path string) (*MountsFile, error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &MountsFile{}
+	if err := yaml.Unmarshal(buff, f); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, spec := range f.Mounts {
+		if spec.Mountpoint == "" || spec.Url == "" {
+			return nil, fmt.Errorf("%s: every mount needs a url and a mountpoint", path)
+		}
+		if seen[spec.Mountpoint] {
+			return nil, fmt.Errorf("%s: %s is mounted twice", path, spec.Mountpoint)
+		}
+		seen[spec.Mountpoint] = true
+		if _, err := spec.Config(Config{}); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, spec.Mountpoint, err)
+		}
+	}
+	return f, nil
+}
+
+// Config returns the defaults with the options of the mount set.
+func (this *MountSpec) Config(defaults Config) (*Config, error) {
+	c := defaults
+	for name, value := range this.Options {
+		if err := c.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// Set sets the field of the config with the flag name, e.g. cache_size.
+func (this *Config) Set(name, value string) error {
+	v := reflect.ValueOf(this).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("flag")
+		if tag == "" || strings.TrimSpace(strings.SplitN(tag, ",", 2)[0]) != name {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case bool:
+			// A bare option, like -o cas, turns it on.
+			if value == "" {
+				value = "true"
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("Bad value of %s: %v", name, err)
+			}
+			field.SetBool(b)
+		case int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("Bad value of %s: %v", name, err)
+			}
+			field.SetInt(int64(n))
+		case uint64:
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Bad value of %s: %v", name, err)
+			}
+			field.SetUint(n)
+		case time.Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("Bad value of %s: %v", name, err)
+			}
+			field.SetInt(int64(d))
+		default:
+			return fmt.Errorf("Option %s can't be set", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown option %s", name)
+}
+
+// MountStatus is the state of a mount managed by a Mounter.
+type MountStatus struct {
+	Mountpoint string    `json:"mountpoint"`
+	Url        string    `json:"url"`
+	Mounted    bool      `json:"mounted"`
+	Since      time.Time `json:"since"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type managedMount struct {
+	spec   *MountSpec
+	closer io.Closer
+	since  time.Time
+	err    error
+}
+
+// Mounter keeps the mounts of a process in line with a list of MountSpecs.
+type Mounter struct {
+	defaults Config
+
+	mu     sync.Mutex
+	mounts map[string]*managedMount
+}
+
+// NewMounter returns a Mounter that uses defaults for the options that aren't set by a mount.
+func NewMounter(defaults Config) *Mounter {
+	return &Mounter{defaults: defaults, mounts: map[string]*managedMount{}}
+}
+
+// Apply unmounts the mounts that are no longer in specs or have changed, then mounts the new and
+// changed ones, and retries those that failed before.  A mount that fails doesn't stop the others;
+// the errors are returned together and are in the status.
+func (this *Mounter) Apply(specs []*MountSpec) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	wanted := map[string]*MountSpec{}
+	for _, spec := range specs {
+		wanted[spec.Mountpoint] = spec
+	}
+	errs := []string{}
+	for mountpoint, m := range this.mounts {
+		if spec, has := wanted[mountpoint]; has && reflect.DeepEqual(spec, m.spec) && m.err == nil && !m.unmounted() {
+			continue
+		}
+		if err := m.unmount(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", mountpoint, err))
+			continue
+		}
+		delete(this.mounts, mountpoint)
+	}
+	for mountpoint, spec := range wanted {
+		if _, has := this.mounts[mountpoint]; has {
+			continue
+		}
+		m := &managedMount{spec: spec, since: time.Now()}
+		this.mounts[mountpoint] = m
+		config, err := spec.Config(this.defaults)
+		if err == nil {
+			m.closer, err = MountUnion(append([]string{spec.Url}, spec.Lower...), mountpoint, config)
+		}
+		if err != nil {
+			m.err = err
+			errs = append(errs, fmt.Sprintf("%s: %v", mountpoint, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// unmounted returns true if it was unmounted by someone else, e.g. kvfs unmount.
+func (this *managedMount) unmounted() bool {
+	if h, is := this.closer.(*handle); is {
+		select {
+		case <-h.Done():
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+func (this *managedMount) unmount() error {
+	if this.closer == nil {
+		return nil
+	}
+	if this.unmounted() {
+		return this.closer.Close()
+	}
+	if err := Unmount(this.spec.Mountpoint); err != nil {
+		return err
+	}
+	return this.closer.Close()
+}
+
+// Status returns the state of the mounts, by mountpoint.
+func (this *Mounter) Status() []*MountStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	out := []*MountStatus{}
+	for mountpoint, m := range this.mounts {
+		s := &MountStatus{
+			Mountpoint: mountpoint,
+			Url:        redactUrl(m.spec.Url),
+			Mounted:    m.err == nil,
+			Since:      m.since,
+		}
+		if m.err != nil {
+			s.Error = m.err.Error()
+		}
+		if m.unmounted() {
+			s.Mounted, s.Error = false, "unmounted"
+		}
+		out = append(out, s)
+	}
+	sort.Sort(mountStatusList(out))
+	return out
+}
+
+// UnmountAll unmounts all the mounts.  Mounts that can't be unmounted, e.g. because they're busy,
+// are kept and their errors returned.
+func (this *Mounter) UnmountAll() error {
+	return this.Apply(nil)
+}
+
+// redactUrl drops the credentials from a url.
+func redactUrl(s string) string {
+	u, err := net.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+type mountStatusList []*MountStatus
+
+func (l mountStatusList) Len() int           { return len(l) }
+func (l mountStatusList) Less(i, j int) bool { return l[i].Mountpoint < l[j].Mountpoint }
+func (l mountStatusList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
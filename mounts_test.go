@@ -0,0 +1,112 @@
+package kvfs
+
+import (
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type TestSuiteMounts struct{}
+
+var _ = Suite(&TestSuiteMounts{})
+
+func (suite *TestSuiteMounts) TestConfigSet(c *C) {
+	for _, t := range []struct {
+		name, value string
+		want        Config
+		err         string
+	}{
+		{"cert", "/etc/kvfs/cert.pem", Config{CertFile: "/etc/kvfs/cert.pem"}, ""},
+		{"cache_size", "1000", Config{CacheSize: 1000}, ""},
+		{"capacity_bytes", "1024", Config{CapacityBytes: 1024}, ""},
+		{"timeout", "5s", Config{ConnectionTimeout: 5 * time.Second}, ""},
+		{"cas", "", Config{CAS: true}, ""},
+		{"cas", "true", Config{CAS: true}, ""},
+		{"cas", "false", Config{}, ""},
+		{"cas", "maybe", Config{}, "Bad value of cas: .*"},
+		{"cache_size", "lots", Config{}, "Bad value of cache_size: .*"},
+		{"capacity_bytes", "-1", Config{}, "Bad value of capacity_bytes: .*"},
+		{"timeout", "5", Config{}, "Bad value of timeout: .*"},
+		{"TLS", "", Config{}, "Unknown option TLS"},
+		{"nope", "1", Config{}, "Unknown option nope"},
+	} {
+		config := Config{}
+		err := config.Set(t.name, t.value)
+		if t.err != "" {
+			c.Assert(err, ErrorMatches, t.err, Commentf("%s=%s", t.name, t.value))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("%s=%s", t.name, t.value))
+		c.Assert(config, DeepEquals, t.want, Commentf("%s=%s", t.name, t.value))
+	}
+}
+
+func (suite *TestSuiteMounts) TestReadMountsFile(c *C) {
+	dir := c.MkDir()
+	for i, t := range []struct {
+		yaml string
+		want []*MountSpec
+		err  string
+	}{
+		{
+			yaml: `
+mounts:
+- mountpoint: /mnt/app
+  url: zk://localhost:2181/app
+  options:
+    cache_size: 1000
+- mountpoint: /mnt/union
+  url: consul://localhost:8500/env
+  lower:
+  - consul://localhost:8500/defaults
+`,
+			want: []*MountSpec{
+				{Mountpoint: "/mnt/app", Url: "zk://localhost:2181/app", Options: map[string]string{"cache_size": "1000"}},
+				{Mountpoint: "/mnt/union", Url: "consul://localhost:8500/env", Lower: []string{"consul://localhost:8500/defaults"}},
+			},
+		},
+		{
+			yaml: "mounts: []\n",
+			want: []*MountSpec{},
+		},
+		{
+			yaml: "mounts:\n- mountpoint: /mnt/app\n",
+			err:  ".*: every mount needs a url and a mountpoint",
+		},
+		{
+			yaml: "mounts:\n- url: zk://localhost:2181/app\n",
+			err:  ".*: every mount needs a url and a mountpoint",
+		},
+		{
+			yaml: "mounts:\n- {mountpoint: /mnt/app, url: zk://a/b}\n- {mountpoint: /mnt/app, url: zk://a/c}\n",
+			err:  ".*: /mnt/app is mounted twice",
+		},
+		{
+			yaml: "mounts:\n- {mountpoint: /mnt/app, url: zk://a/b, options: {cache_size: lots}}\n",
+			err:  ".*: /mnt/app: Bad value of cache_size: .*",
+		},
+		{
+			yaml: "mounts:\n- {mountpoint: /mnt/app, url: zk://a/b, options: {nope: 1}}\n",
+			err:  ".*: /mnt/app: Unknown option nope",
+		},
+		{
+			yaml: "mounts: {\n",
+			err:  "yaml: .*",
+		},
+	} {
+		path := filepath.Join(dir, "mounts.yaml")
+		c.Assert(ioutil.WriteFile(path, []byte(t.yaml), 0644), IsNil)
+		f, err := ReadMountsFile(path)
+		if t.err != "" {
+			c.Assert(err, ErrorMatches, t.err, Commentf("case %d", i))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("case %d", i))
+		c.Assert(f.Mounts, DeepEquals, t.want, Commentf("case %d", i))
+	}
+
+	_, err := ReadMountsFile(filepath.Join(dir, "missing.yaml"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
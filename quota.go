@@ -0,0 +1,246 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+// How long quotas and the usage of directories with a quota are reused before they're read again.
+// Writes through the mount are counted in the meantime.
+const quotaTTL = 30 * time.Second
+
+// Quota limits a directory and everything below it.  It's stored as json in the kv store, in the
+// QuotaMarker entry of the directory, so it applies to every mount.  Zero is no limit.
+type Quota struct {
+	MaxBytes    uint64 `json:"max_bytes,omitempty"`
+	MaxEntries  uint64 `json:"max_entries,omitempty"`
+	MaxFileSize uint64 `json:"max_file_size,omitempty"`
+}
+
+func (this *Backend) quotaKey(path []string) string {
+	return filepath.Join(append(append(append([]string{}, this.Root...), path...), QuotaMarker)...)
+}
+
+// Quota returns the quota of the directory at path below the root, or nil if it has none.
+func (this *Backend) Quota(path []string) (*Quota, error) {
+	return this.quotaAt(this.quotaKey(path))
+}
+
+// CheckEntries returns an error if one more entry in the directory at path below the root would
+// exceed a quota, like the mount checks before it creates a file or directory.
+func (this *Backend) CheckEntries(dir []string) error {
+	return newQuotas(this).checkEntries(dir)
+}
+
+// CheckWrite returns an error if writing a value of size bytes in the directory at path below the
+// root, growing the values in it by delta bytes, would exceed a quota, like the mount checks
+// before it writes a file.
+func (this *Backend) CheckWrite(dir []string, size uint64, delta int64) error {
+	q := newQuotas(this)
+	if err := q.checkSize(dir, size); err != nil {
+		return err
+	}
+	return q.checkBytes(dir, delta)
+}
+
+func (this *Backend) quotaAt(key string) (*Quota, error) {
+	kv, err := this.store.Get(key)
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q := &Quota{}
+	if err := json.Unmarshal(kv.Value, q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// SetQuota sets the quota of the directory at path below the root.
+func (this *Backend) SetQuota(path []string, q *Quota) error {
+	buff, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return this.store.Put(this.quotaKey(path), buff, nil)
+}
+
+// DeleteQuota removes the quota of the directory at path below the root.
+func (this *Backend) DeleteQuota(path []string) error {
+	err := this.store.Delete(this.quotaKey(path))
+	if err == store.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// quotaState is a quota and the usage of its directory.
+type quotaState struct {
+	path    string
+	quota   *Quota
+	usage   *Usage
+	fetched time.Time
+}
+
+// quotas enforces the quotas of the directories above the files written through the mount,
+// including the ones above the root of the mount.
+type quotas struct {
+	db *Backend
+
+	mu sync.Mutex
+	// by absolute path of the directory; quota is nil for directories without one
+	states map[string]*quotaState
+}
+
+func newQuotas(db *Backend) *quotas {
+	return &quotas{db: db, states: map[string]*quotaState{}}
+}
+
+// limits returns the quotas of dir, given as a path below the root, and of all its parents.
+// Quotas that can't be read, e.g. because the kv store is down, are not enforced.
+func (q *quotas) limits(dir []string) []*quotaState {
+	abs := append(append([]string{}, q.db.Root...), dir...)
+	out := []*quotaState{}
+	seen := map[string]bool{}
+	for i := len(abs); i >= 0; i-- {
+		p := filepath.Join(abs[:i]...)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		if s := q.state(p); s != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (q *quotas) state(p string) *quotaState {
+	q.mu.Lock()
+	s, has := q.states[p]
+	q.mu.Unlock()
+	if has && time.Since(s.fetched) < quotaTTL {
+		if s.quota == nil {
+			return nil
+		}
+		return s
+	}
+
+	quota, err := q.db.quotaAt(filepath.Join(p, QuotaMarker))
+	if err != nil {
+		return nil
+	}
+	s = &quotaState{path: p, quota: quota, fetched: time.Now()}
+	if quota != nil {
+		if s.usage, err = q.db.usageAt(p); err != nil {
+			return nil
+		}
+	}
+	q.mu.Lock()
+	q.states[p] = s
+	q.mu.Unlock()
+	if quota == nil {
+		return nil
+	}
+	return s
+}
+
+// checkEntries returns an error if one more entry in dir would exceed a quota.
+func (q *quotas) checkEntries(dir []string) error {
+	if q == nil {
+		return nil
+	}
+	for _, s := range q.limits(dir) {
+		q.mu.Lock()
+		used := s.usage.Keys + s.usage.Dirs
+		q.mu.Unlock()
+		if s.quota.MaxEntries > 0 && used+1 > s.quota.MaxEntries {
+			return &ErrQuotaExceeded{Path: s.path, Limit: "max_entries"}
+		}
+	}
+	return nil
+}
+
+// checkSize returns an error if a file of the given size in dir would be too large.
+func (q *quotas) checkSize(dir []string, size uint64) error {
+	if q == nil {
+		return nil
+	}
+	for _, s := range q.limits(dir) {
+		if s.quota.MaxFileSize > 0 && size > s.quota.MaxFileSize {
+			return &ErrFileTooLarge{Path: s.path}
+		}
+		if s.quota.MaxBytes > 0 && size > s.quota.MaxBytes {
+			return &ErrFileTooLarge{Path: s.path}
+		}
+	}
+	return nil
+}
+
+// checkBytes returns an error if growing the values in dir by delta bytes would exceed a quota.
+func (q *quotas) checkBytes(dir []string, delta int64) error {
+	if q == nil || delta <= 0 {
+		return nil
+	}
+	for _, s := range q.limits(dir) {
+		q.mu.Lock()
+		used := s.usage.Bytes
+		q.mu.Unlock()
+		if s.quota.MaxBytes > 0 && used+uint64(delta) > s.quota.MaxBytes {
+			return &ErrQuotaExceeded{Path: s.path, Limit: "max_bytes"}
+		}
+	}
+	return nil
+}
+
+// charge counts a write through the mount in the usage of the quotas above dir.
+func (q *quotas) charge(dir []string, keys, dirs, bytes int64) {
+	if q == nil {
+		return
+	}
+	for _, s := range q.limits(dir) {
+		q.mu.Lock()
+		s.usage.Keys = add(s.usage.Keys, keys)
+		s.usage.Dirs = add(s.usage.Dirs, dirs)
+		s.usage.Bytes = add(s.usage.Bytes, bytes)
+		q.mu.Unlock()
+	}
+}
+
+// flush forgets the quotas and usage, e.g. after quotas were changed.
+func (q *quotas) flush() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.states = map[string]*quotaState{}
+}
+
+// rootLimit returns the quota of the root of the mount, or of the nearest parent with one, and
+// its usage.
+func (q *quotas) rootLimit() (*Quota, Usage, bool) {
+	if q == nil {
+		return nil, Usage{}, false
+	}
+	limits := q.limits(nil)
+	if len(limits) == 0 {
+		return nil, Usage{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return limits[0].quota, *limits[0].usage, true
+}
+
+func add(v uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > v {
+		return 0
+	}
+	return uint64(int64(v) + delta)
+}
@@ -0,0 +1,242 @@
+package kvfs
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	etcd "github.com/coreos/etcd/client"
+	"github.com/docker/libkv/store"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// transient returns true if the error means the kv store couldn't be reached or didn't answer in
+// time, as opposed to an answer like key not found.
+func transient(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case store.ErrNotReachable, etcd.ErrClusterUnavailable,
+		zk.ErrNoServer, zk.ErrConnectionClosed, zk.ErrSessionExpired, zk.ErrSessionMoved, zk.ErrClosing:
+		return true
+	}
+	switch err := err.(type) {
+	case *ErrBackendUnavailable:
+		return true
+	case *etcd.ClusterError:
+		return true
+	case *url.Error:
+		return transient(err.Err)
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// Breaker fails calls fast once the kv store failed Threshold times in a row.  After Cooldown, calls
+// are let through again and the first one decides whether the breaker closes or opens again.
+type Breaker struct {
+	// Zero disables the breaker
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	lastErr  error
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.Cooldown {
+			return &ErrBackendUnavailable{Cause: b.lastErr, FailFast: true}
+		}
+		b.state = BreakerHalfOpen
+	}
+	return nil
+}
+
+func (b *Breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.lastErr = nil
+}
+
+func (b *Breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastErr = err
+	if b.Threshold > 0 && (b.state == BreakerHalfOpen || b.failures >= b.Threshold) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the state of the breaker, the number of consecutive failures and the last error.
+func (b *Breaker) State() (string, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == "" {
+		return BreakerClosed, b.failures, b.lastErr
+	}
+	return b.state, b.failures, b.lastErr
+}
+
+// retryStore is a store.Store decorator that retries calls that failed because the kv store was
+// unreachable or timed out, waiting wait, then twice as long, etc. in between.  Calls that still
+// fail return *ErrBackendUnavailable.
+type retryStore struct {
+	store.Store
+	retries int
+	wait    time.Duration
+	breaker *Breaker
+}
+
+func (s *retryStore) do(fn func() error) error {
+	if err := s.breaker.allow(); err != nil {
+		return err
+	}
+	wait := s.wait
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if !transient(err) {
+			s.breaker.success()
+			return err
+		}
+		if attempt >= s.retries {
+			break
+		}
+		time.Sleep(wait)
+		wait = wait * 2
+	}
+	s.breaker.failure(err)
+	return &ErrBackendUnavailable{Cause: err}
+}
+
+func (s *retryStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	return s.do(func() error {
+		return s.Store.Put(key, value, options)
+	})
+}
+
+func (s *retryStore) Get(key string) (kv *store.KVPair, err error) {
+	err = s.do(func() error {
+		kv, err = s.Store.Get(key)
+		return err
+	})
+	return
+}
+
+func (s *retryStore) Delete(key string) error {
+	return s.do(func() error {
+		return s.Store.Delete(key)
+	})
+}
+
+func (s *retryStore) Exists(key string) (ok bool, err error) {
+	err = s.do(func() error {
+		ok, err = s.Store.Exists(key)
+		return err
+	})
+	return
+}
+
+func (s *retryStore) Watch(key string, stopCh <-chan struct{}) (ch <-chan *store.KVPair, err error) {
+	err = s.do(func() error {
+		ch, err = s.Store.Watch(key, stopCh)
+		return err
+	})
+	return
+}
+
+func (s *retryStore) WatchTree(directory string, stopCh <-chan struct{}) (ch <-chan []*store.KVPair, err error) {
+	err = s.do(func() error {
+		ch, err = s.Store.WatchTree(directory, stopCh)
+		return err
+	})
+	return
+}
+
+func (s *retryStore) List(directory string) (list []*store.KVPair, err error) {
+	err = s.do(func() error {
+		list, err = s.Store.List(directory)
+		return err
+	})
+	return
+}
+
+func (s *retryStore) DeleteTree(directory string) error {
+	return s.do(func() error {
+		return s.Store.DeleteTree(directory)
+	})
+}
+
+// AtomicPut is safe to retry: if a timed out attempt went through, the retry fails with
+// ErrKeyModified instead of applying the change twice.
+func (s *retryStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (ok bool, kv *store.KVPair, err error) {
+	err = s.do(func() error {
+		ok, kv, err = s.Store.AtomicPut(key, value, previous, options)
+		return err
+	})
+	return
+}
+
+func (s *retryStore) AtomicDelete(key string, previous *store.KVPair) (ok bool, err error) {
+	err = s.do(func() error {
+		ok, err = s.Store.AtomicDelete(key, previous)
+		return err
+	})
+	return
+}
+
+// errno maps errors from the kv store to errnos for fuse.  A kv store that can't be reached
+// is EAGAIN while the breaker is open and EIO otherwise, rather than looking like missing files.
+func errno(err error) error {
+	if _, is := err.(fuse.ErrorNumber); is || err == nil {
+		return err
+	}
+	switch err := err.(type) {
+	case *ErrNotFound:
+		return fuse.ENOENT
+	case *ErrNotDir:
+		return fuse.Errno(syscall.ENOTDIR)
+	case *ErrQuotaExceeded:
+		return fuse.Errno(syscall.EDQUOT)
+	case *ErrFileTooLarge:
+		return fuse.Errno(syscall.EFBIG)
+	case *ErrConflict:
+		return fuse.ESTALE
+	case *ErrBackendUnavailable:
+		if err.FailFast {
+			return fuse.Errno(syscall.EAGAIN)
+		}
+		return fuse.EIO
+	}
+	switch err {
+	case store.ErrKeyNotFound:
+		return fuse.ENOENT
+	case store.ErrKeyExists:
+		return fuse.EEXIST
+	}
+	return err
+}
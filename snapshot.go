@@ -0,0 +1,329 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+// SnapshotManifest describes a snapshot.  The copy of the subtree is in the system directory at
+// snapshots/<name>, and the manifest at snapshot-manifests/<name>.
+type SnapshotManifest struct {
+	Name string `json:"name"`
+	// Path of the subtree below the root, e.g. /app
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Keys    int       `json:"keys"`
+	Dirs    int       `json:"dirs"`
+	Bytes   int       `json:"bytes"`
+	// LastIndex of every key when it was copied, by path below the subtree
+	Index map[string]uint64 `json:"index"`
+}
+
+func (this *Backend) snapshotDir(name string) []string {
+	return this.systemPath("snapshots", name)
+}
+
+func (this *Backend) snapshotManifest(name string) string {
+	return filepath.Join(this.systemPath("snapshot-manifests", name)...)
+}
+
+// CreateSnapshot copies the subtree at path below the root into a new snapshot.
+func (this *Backend) CreateSnapshot(name string, path []string) (*SnapshotManifest, error) {
+	if name == "" || strings.Contains(name, "/") || IsMarker(name) {
+		return nil, fmt.Errorf("Invalid snapshot name %q", name)
+	}
+	if exists, err := this.store.Exists(this.snapshotManifest(name)); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, store.ErrKeyExists
+	}
+
+	m := &SnapshotManifest{
+		Name:    name,
+		Path:    "/" + filepath.Join(path...),
+		Created: time.Now(),
+		Index:   map[string]uint64{},
+	}
+	from := NewStrictDirLike(this.store, append(append([]string{}, this.Root...), path...), this.Handler)
+	snapshots := NewStrictDirLike(this.store, this.systemPath("snapshots"), this.Handler)
+	// A tree left behind without a manifest, e.g. by a crash, isn't merged into.
+	if _, err := snapshots.Stat(name); err == nil {
+		return nil, store.ErrKeyExists
+	} else if _, is := err.(*ErrNotFound); !is {
+		return nil, err
+	}
+	to, err := snapshots.CreateDir(name)
+	if err != nil {
+		return nil, err
+	}
+	err = copyTree(from, to, "", func(rel string, kv *store.KVPair) {
+		if kv == nil {
+			m.Dirs++
+			return
+		}
+		m.Keys++
+		m.Bytes += len(kv.Value)
+		m.Index[rel] = kv.LastIndex
+	})
+	if err != nil {
+		// best effort, so the name can be used again
+		snapshots.DeleteDir(name)
+		return nil, err
+	}
+
+	buff, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.store.Put(this.snapshotManifest(name), buff, nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// copyTree copies the tree below from to to with DirLike traversal, and the quotas of the
+// directories.  fn is called with the path below from of every directory, with a nil kv, and of
+// every key.
+func copyTree(from, to StrictDirLike, rel string, fn func(rel string, kv *store.KVPair)) error {
+	// Listings skip markers.
+	if q, err := from.Get(QuotaMarker); err == nil {
+		if err := to.Put(QuotaMarker, q); err != nil {
+			return err
+		}
+	} else if _, is := err.(*ErrNotFound); !is {
+		return err
+	}
+	for entry := range from.Cursor() {
+		if entry.Err != nil {
+			return entry.Err
+		}
+		if entry.Dir {
+			fromChild, err := from.Dir(entry.Key)
+			if err != nil {
+				return err
+			}
+			toChild, err := to.CreateDir(entry.Key)
+			if err != nil {
+				return err
+			}
+			fn(filepath.Join(rel, entry.Key), nil)
+			if err := copyTree(fromChild, toChild, filepath.Join(rel, entry.Key), fn); err != nil {
+				return err
+			}
+			continue
+		}
+		kv, err := from.GetPair(entry.Key)
+		if err != nil {
+			return err
+		}
+		if err := to.Put(entry.Key, kv.Value); err != nil {
+			return err
+		}
+		fn(filepath.Join(rel, entry.Key), kv)
+	}
+	return nil
+}
+
+// Snapshots returns the manifests of the snapshots, by name.
+func (this *Backend) Snapshots() ([]*SnapshotManifest, error) {
+	dir := filepath.Join(this.systemPath("snapshot-manifests")...)
+	list, err := this.store.List(dir)
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []*SnapshotManifest{}
+	for _, kv := range list {
+		m := &SnapshotManifest{}
+		if err := json.Unmarshal(kv.Value, m); err != nil {
+			continue
+		}
+		out = append(out, m)
+	}
+	sort.Sort(manifestsByName(out))
+	return out, nil
+}
+
+// Snapshot returns the manifest of a snapshot.
+func (this *Backend) Snapshot(name string) (*SnapshotManifest, error) {
+	kv, err := this.store.Get(this.snapshotManifest(name))
+	if err == store.ErrKeyNotFound {
+		return nil, &ErrNotFound{name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &SnapshotManifest{}
+	return m, json.Unmarshal(kv.Value, m)
+}
+
+// DeleteSnapshot deletes a snapshot and its copy of the subtree.
+func (this *Backend) DeleteSnapshot(name string) error {
+	if _, err := this.Snapshot(name); err != nil {
+		return err
+	}
+	snapshots := NewStrictDirLike(this.store, this.systemPath("snapshots"), this.Handler)
+	if err := snapshots.DeleteDir(name); err != nil {
+		if _, is := err.(*ErrNotFound); !is {
+			return err
+		}
+	}
+	return this.store.Delete(this.snapshotManifest(name))
+}
+
+// tree is the keys and directories found by a walk, by path below the top of the walk.
+type tree struct {
+	keys map[string]*store.KVPair
+	dirs map[string]bool
+}
+
+// tree walks the tree below p.  Anything with children is a directory.
+func (this *Backend) tree(p string) (*tree, error) {
+	t := &tree{keys: map[string]*store.KVPair{}, dirs: map[string]bool{}}
+	all := map[string]*store.KVPair{}
+	err := this.walk(p, func(child string, kv *store.KVPair) {
+		rel := strings.TrimPrefix(strings.TrimPrefix(child, strings.TrimPrefix(p, "/")), "/")
+		all[rel] = kv
+		for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+			t.dirs[dir] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for rel, kv := range all {
+		if !t.dirs[rel] && !IsMarker(filepath.Base(rel)) {
+			t.keys[rel] = kv
+		}
+	}
+	return t, nil
+}
+
+// RestoreSnapshot makes the subtree the same as when the snapshot was taken.  Keys that differ are
+// written, or deleted, with compare-and-swap against the value read when computing the diff; if
+// one was changed in the meantime, the restore stops with *ErrConflict and can be run again.
+// With dryRun, the changes are returned but not made.
+func (this *Backend) RestoreSnapshot(name string, dryRun bool) ([]*Change, error) {
+	m, err := this.Snapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	path := relPath(m.Path)
+	target := append(append([]string{}, this.Root...), path...)
+	saved, err := this.tree(filepath.Join(this.snapshotDir(name)...))
+	if err != nil {
+		return nil, err
+	}
+	current, err := this.tree(filepath.Join(target...))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	changes := []*Change{}
+	change := func(rel string, dir bool, op string) {
+		changes = append(changes, &Change{Key: "/" + filepath.Join(append(append([]string{}, path...), rel)...), Dir: dir, Op: op, Time: now})
+	}
+	key := func(rel string) string {
+		return filepath.Join(append(append([]string{}, target...), rel)...)
+	}
+
+	// Directories first, so the keys below them can be written.
+	for _, rel := range saved.paths(true) {
+		if current.dirs[rel] {
+			continue
+		}
+		change(rel, true, OpPut)
+		if dryRun {
+			continue
+		}
+		parent := append(append([]string{}, target...), relPath(filepath.Dir(rel))...)
+		if _, err := NewStrictDirLike(this.store, parent, this.Handler).CreateDir(filepath.Base(rel)); err != nil {
+			return changes, err
+		}
+	}
+	for _, rel := range saved.paths(false) {
+		kv := saved.keys[rel]
+		prev, has := current.keys[rel]
+		if has && string(prev.Value) == string(kv.Value) {
+			continue
+		}
+		change(rel, false, OpPut)
+		if dryRun {
+			continue
+		}
+		if !has {
+			prev = nil
+		}
+		if _, _, err := this.store.AtomicPut(key(rel), kv.Value, prev, nil); err != nil {
+			if err == store.ErrKeyModified || err == store.ErrKeyExists {
+				return changes, &ErrConflict{key(rel)}
+			}
+			return changes, err
+		}
+	}
+	for _, rel := range current.paths(false) {
+		if _, has := saved.keys[rel]; has {
+			continue
+		}
+		change(rel, false, OpDelete)
+		if dryRun {
+			continue
+		}
+		if _, err := this.store.AtomicDelete(key(rel), current.keys[rel]); err != nil {
+			if err == store.ErrKeyModified {
+				return changes, &ErrConflict{key(rel)}
+			}
+			if err != store.ErrKeyNotFound {
+				return changes, err
+			}
+		}
+	}
+	// Deepest first, so the directories are empty by then.
+	dirs := current.paths(true)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel := dirs[i]
+		if saved.dirs[rel] {
+			continue
+		}
+		change(rel, true, OpDelete)
+		if dryRun {
+			continue
+		}
+		parent := append(append([]string{}, target...), relPath(filepath.Dir(rel))...)
+		if err := NewDirLike(this.store, parent, this.Handler).DeleteDir(filepath.Base(rel)); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// paths returns the paths of the keys, or of the directories, sorted.
+func (t *tree) paths(dirs bool) []string {
+	out := []string{}
+	if dirs {
+		for p := range t.dirs {
+			out = append(out, p)
+		}
+	} else {
+		for p := range t.keys {
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+type manifestsByName []*SnapshotManifest
+
+func (l manifestsByName) Len() int           { return len(l) }
+func (l manifestsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l manifestsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
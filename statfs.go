@@ -0,0 +1,257 @@
+package kvfs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	net_url "net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/docker/libkv/store"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Fragment size the block counts of statfs are in.
+	statfsFrsize = 4096
+	// How long the usage computed for statfs is reused.
+	statfsTTL = 30 * time.Second
+	// Free bytes and keys reported when there is no limit.
+	unlimitedBytes = 1 << 40
+	unlimitedKeys  = 1 << 24
+	// Longest name allowed in a directory.
+	maxNameLen = 255
+)
+
+// Usage is the number of keys and directories below a path and the size of the values.
+type Usage struct {
+	Keys  uint64 `json:"keys"`
+	Dirs  uint64 `json:"dirs"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// StoreUsage is the usage of the whole kv store as reported by the kv store itself.  Zero values
+// are not known.
+type StoreUsage struct {
+	Keys  uint64 `json:"keys,omitempty"`
+	Bytes uint64 `json:"bytes,omitempty"`
+	// Size the kv store is limited to, e.g. the etcd backend quota
+	CapacityBytes uint64 `json:"capacity_bytes,omitempty"`
+}
+
+// Usage walks the tree below path and adds up the keys and the size of the values.  Directories
+// are not counted as keys, and path itself is not counted.
+func (this *Backend) Usage(path []string) (*Usage, error) {
+	return this.usageAt(filepath.Join(append(append([]string{}, this.Root...), path...)...))
+}
+
+func (this *Backend) usageAt(p string) (*Usage, error) {
+	values := map[string]int{}
+	dirs := map[string]bool{}
+	err := this.walk(p, func(child string, kv *store.KVPair) {
+		switch filepath.Base(child) {
+		case DirMarker:
+			dirs[filepath.Dir(child)] = true
+			return
+		case QuotaMarker:
+			return
+		}
+		values[child] = len(kv.Value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	delete(dirs, p)
+	usage := &Usage{Dirs: uint64(len(dirs))}
+	for k, size := range values {
+		if !dirs[k] {
+			usage.Keys++
+			usage.Bytes += uint64(size)
+		}
+	}
+	return usage, nil
+}
+
+// StoreUsage asks the kv store for its own usage.  Only zk (mntr) and etcd (metrics) support it.
+func (this *Backend) StoreUsage() (*StoreUsage, error) {
+	if this.Handler.StoreUsage == nil {
+		return nil, &ErrNotSupported{this.Url.Scheme}
+	}
+	return this.Handler.StoreUsage(this.Url, this.tls)
+}
+
+// zkStoreUsage sends the mntr four letter word to the first zk server that answers.
+func zkStoreUsage(u *net_url.URL, _ *tls.Config) (*StoreUsage, error) {
+	var lastErr error
+	for _, host := range strings.Split(u.Host, ",") {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "2181")
+		}
+		conn, err := net.DialTimeout("tcp", host, pingTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(pingTimeout))
+		fmt.Fprint(conn, "mntr")
+		usage := &StoreUsage{}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue
+			}
+			v, _ := strconv.ParseUint(fields[1], 10, 64)
+			switch fields[0] {
+			case "zk_znode_count":
+				usage.Keys = v
+			case "zk_approximate_data_size":
+				usage.Bytes = v
+			}
+		}
+		conn.Close()
+		if err := scanner.Err(); err != nil {
+			lastErr = err
+			continue
+		}
+		return usage, nil
+	}
+	return nil, lastErr
+}
+
+// etcdStoreUsage reads the db size and quota from the metrics of the first etcd member that answers.
+func etcdStoreUsage(u *net_url.URL, tlsConfig *tls.Config) (*StoreUsage, error) {
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	client := &http.Client{
+		Timeout:   pingTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	var lastErr error
+	for _, host := range strings.Split(u.Host, ",") {
+		resp, err := client.Get(scheme + "://" + host + "/metrics")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		usage := &StoreUsage{}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue
+			}
+			v, _ := strconv.ParseFloat(fields[1], 64)
+			switch fields[0] {
+			case "etcd_mvcc_db_total_size_in_bytes", "etcd_debugging_mvcc_db_total_size_in_bytes":
+				usage.Bytes = uint64(v)
+			case "etcd_debugging_mvcc_keys_total":
+				usage.Keys = uint64(v)
+			case "etcd_server_quota_backend_bytes":
+				usage.CapacityBytes = uint64(v)
+			}
+		}
+		resp.Body.Close()
+		if err := scanner.Err(); err != nil {
+			lastErr = err
+			continue
+		}
+		return usage, nil
+	}
+	return nil, lastErr
+}
+
+// usageCache keeps the usage for statfs for statfsTTL, since computing it walks the whole tree.
+type usageCache struct {
+	mu      sync.Mutex
+	usage   *Usage
+	store   *StoreUsage
+	updated time.Time
+}
+
+func (f *FS) usage() (*Usage, *StoreUsage, error) {
+	c := &f.statfs
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.usage != nil && time.Since(c.updated) < statfsTTL {
+		return c.usage, c.store, nil
+	}
+	usage, err := f.db.Usage(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.usage, c.store, c.updated = usage, nil, time.Now()
+	if f.storeUsage {
+		// Best effort; not every kv store can tell.
+		c.store, _ = f.db.StoreUsage()
+	}
+	return c.usage, c.store, nil
+}
+
+var _ = fs.FSStatfser(&FS{})
+
+// Statfs reports the keys and bytes used below the root against the configured capacity, or the
+// capacity of the kv store if it's known, or the quota of the root if it's lower.  Without a
+// limit, a large amount of free space is reported.  The block size is the largest value the kv
+// store accepts.
+func (f *FS) Statfs(c context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
+	defer f.stats.fuseOp("Statfs", time.Now(), &err)
+
+	usage, storeUsage, err := f.usage()
+	if err != nil {
+		return errno(err)
+	}
+
+	usedBytes := usage.Bytes
+	totalBytes := f.capacityBytes
+	if totalBytes == 0 && storeUsage != nil && storeUsage.CapacityBytes > 0 {
+		// The capacity is shared with everything else in the kv store.
+		totalBytes = storeUsage.CapacityBytes
+		usedBytes = storeUsage.Bytes
+	}
+	usedKeys := usage.Keys + usage.Dirs
+	totalKeys := f.capacityKeys
+	if quota, quotaUsage, has := f.quotas.rootLimit(); has {
+		if quota.MaxBytes > 0 && (totalBytes == 0 || quota.MaxBytes < totalBytes) {
+			totalBytes, usedBytes = quota.MaxBytes, quotaUsage.Bytes
+		}
+		if quota.MaxEntries > 0 && (totalKeys == 0 || quota.MaxEntries < totalKeys) {
+			totalKeys, usedKeys = quota.MaxEntries, quotaUsage.Keys+quotaUsage.Dirs
+		}
+	}
+	freeBytes := uint64(unlimitedBytes)
+	if totalBytes > 0 {
+		freeBytes = 0
+		if totalBytes > usedBytes {
+			freeBytes = totalBytes - usedBytes
+		}
+	}
+	freeKeys := uint64(unlimitedKeys)
+	if totalKeys > 0 {
+		freeKeys = 0
+		if totalKeys > usedKeys {
+			freeKeys = totalKeys - usedKeys
+		}
+	}
+
+	resp.Frsize = statfsFrsize
+	resp.Bsize = uint32(f.db.Handler.MaxValueSize)
+	resp.Blocks = (usedBytes + freeBytes + statfsFrsize - 1) / statfsFrsize
+	resp.Bfree = freeBytes / statfsFrsize
+	resp.Bavail = resp.Bfree
+	resp.Files = usedKeys + freeKeys
+	resp.Ffree = freeKeys
+	resp.Namelen = maxNameLen
+	return nil
+}
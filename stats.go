@@ -0,0 +1,222 @@
+package kvfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+// Upper bounds of the latency histogram buckets.
+var LatencyBuckets = []time.Duration{
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// OpStats are the counters of one kind of operation.
+type OpStats struct {
+	Count   uint64        `json:"count"`
+	Errors  uint64        `json:"errors"`
+	Total   time.Duration `json:"total_ns"`
+	Max     time.Duration `json:"max_ns"`
+	Average time.Duration `json:"avg_ns"`
+	// Number of operations per latency bucket (not cumulative).  The last one is for the
+	// operations slower than the largest of LatencyBuckets.
+	Buckets []uint64 `json:"-"`
+}
+
+// Stats counts the fuse operations served by the mount and the calls made to the kv store.
+type Stats struct {
+	mu    sync.Mutex
+	fuse  map[string]*OpStats
+	store map[string]*OpStats
+
+	cacheHits   uint64
+	cacheMisses uint64
+	staleReads  uint64
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		fuse:  map[string]*OpStats{},
+		store: map[string]*OpStats{},
+	}
+}
+
+func (s *Stats) observe(ops map[string]*OpStats, op string, start time.Time, err error) {
+	elapsed := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, has := ops[op]
+	if !has {
+		o = &OpStats{Buckets: make([]uint64, len(LatencyBuckets)+1)}
+		ops[op] = o
+	}
+	i := 0
+	for i < len(LatencyBuckets) && elapsed > LatencyBuckets[i] {
+		i++
+	}
+	o.Buckets[i]++
+	o.Count++
+	if err != nil {
+		o.Errors++
+	}
+	o.Total += elapsed
+	if elapsed > o.Max {
+		o.Max = elapsed
+	}
+}
+
+// fuseOp records a fuse operation.  Use as defer f.stats.fuseOp("Lookup", time.Now(), &err)
+func (s *Stats) fuseOp(op string, start time.Time, err *error) {
+	s.observe(s.fuse, op, start, *err)
+}
+
+func (s *Stats) storeOp(op string, start time.Time, err error) {
+	s.observe(s.store, op, start, err)
+}
+
+func (s *Stats) cacheHit() {
+	atomic.AddUint64(&s.cacheHits, 1)
+}
+
+func (s *Stats) cacheMiss() {
+	atomic.AddUint64(&s.cacheMisses, 1)
+}
+
+func (s *Stats) staleRead() {
+	atomic.AddUint64(&s.staleReads, 1)
+}
+
+// StatsSnapshot is a copy of the counters at a point in time.
+type StatsSnapshot struct {
+	Fuse        map[string]OpStats `json:"fuse"`
+	Store       map[string]OpStats `json:"store"`
+	CacheHits   uint64             `json:"cache_hits"`
+	CacheMisses uint64             `json:"cache_misses"`
+	StaleReads  uint64             `json:"stale_reads"`
+}
+
+func (s *Stats) Snapshot() *StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copyOps := func(ops map[string]*OpStats) map[string]OpStats {
+		out := map[string]OpStats{}
+		for k, v := range ops {
+			o := *v
+			o.Buckets = append([]uint64(nil), v.Buckets...)
+			if o.Count > 0 {
+				o.Average = o.Total / time.Duration(o.Count)
+			}
+			out[k] = o
+		}
+		return out
+	}
+	return &StatsSnapshot{
+		Fuse:        copyOps(s.fuse),
+		Store:       copyOps(s.store),
+		CacheHits:   atomic.LoadUint64(&s.cacheHits),
+		CacheMisses: atomic.LoadUint64(&s.cacheMisses),
+		StaleReads:  atomic.LoadUint64(&s.staleReads),
+	}
+}
+
+// statsStore is a store.Store decorator that counts the calls made to the kv store.
+type statsStore struct {
+	store.Store
+	stats *Stats
+}
+
+func (s *statsStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	start := time.Now()
+	err := s.Store.Put(key, value, options)
+	s.stats.storeOp("Put", start, err)
+	return err
+}
+
+func (s *statsStore) Get(key string) (*store.KVPair, error) {
+	start := time.Now()
+	kv, err := s.Store.Get(key)
+	s.stats.storeOp("Get", start, notFoundIsNil(err))
+	return kv, err
+}
+
+func (s *statsStore) Delete(key string) error {
+	start := time.Now()
+	err := s.Store.Delete(key)
+	s.stats.storeOp("Delete", start, notFoundIsNil(err))
+	return err
+}
+
+func (s *statsStore) Exists(key string) (bool, error) {
+	start := time.Now()
+	ok, err := s.Store.Exists(key)
+	s.stats.storeOp("Exists", start, err)
+	return ok, err
+}
+
+func (s *statsStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	start := time.Now()
+	ch, err := s.Store.Watch(key, stopCh)
+	s.stats.storeOp("Watch", start, err)
+	return ch, err
+}
+
+func (s *statsStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	start := time.Now()
+	ch, err := s.Store.WatchTree(directory, stopCh)
+	s.stats.storeOp("WatchTree", start, err)
+	return ch, err
+}
+
+func (s *statsStore) List(directory string) ([]*store.KVPair, error) {
+	start := time.Now()
+	list, err := s.Store.List(directory)
+	s.stats.storeOp("List", start, notFoundIsNil(err))
+	return list, err
+}
+
+func (s *statsStore) DeleteTree(directory string) error {
+	start := time.Now()
+	err := s.Store.DeleteTree(directory)
+	s.stats.storeOp("DeleteTree", start, notFoundIsNil(err))
+	return err
+}
+
+func (s *statsStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	start := time.Now()
+	ok, kv, err := s.Store.AtomicPut(key, value, previous, options)
+	s.stats.storeOp("AtomicPut", start, err)
+	return ok, kv, err
+}
+
+func (s *statsStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	start := time.Now()
+	ok, err := s.Store.AtomicDelete(key, previous)
+	s.stats.storeOp("AtomicDelete", start, err)
+	return ok, err
+}
+
+// A missing key is an answer, not a failure of the kv store.
+func notFoundIsNil(err error) error {
+	if err == store.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
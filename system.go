@@ -0,0 +1,136 @@
+package kvfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// systemPath returns the path of an entry of the system directory, e.g. the history.
+func (this *Backend) systemPath(elem ...string) []string {
+	return append(append(append([]string{}, this.Root...), SystemDir), elem...)
+}
+
+// relPath splits a path below the root, dropping empty elements.
+func relPath(elem ...string) []string {
+	p := strings.Trim(filepath.Join(elem...), "/")
+	if p == "" || p == "." {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+// ReadOnlyDir is a read-only view of a tree of the kv store outside of the mounted tree, like
+// the history in the system directory.  value turns the value of a key into the content of the file.
+type ReadOnlyDir struct {
+	fs *FS
+	// absolute path
+	path  []string
+	value func([]byte) []byte
+}
+
+var _ = fs.Node(&ReadOnlyDir{})
+
+func (d *ReadOnlyDir) Attr(c context.Context, a *fuse.Attr) error {
+	a.Inode = inode(filepath.Join(d.path...))
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+var _ = fs.HandleReadDirAller(&ReadOnlyDir{})
+
+func (d *ReadOnlyDir) ReadDirAll(c context.Context) (res []fuse.Dirent, err error) {
+	defer d.fs.stats.fuseOp("ReadDirAll", time.Now(), &err)
+
+	b := NewStrictDirLike(d.fs.db.store, d.path, d.fs.db.Handler)
+	for entry := range b.Cursor() {
+		if entry.Err != nil {
+			return nil, errno(entry.Err)
+		}
+		de := fuse.Dirent{
+			Inode: inode(filepath.Join(append(d.path, entry.Key)...)),
+			Name:  entry.Key,
+			Type:  fuse.DT_File,
+		}
+		if entry.Dir {
+			de.Type = fuse.DT_Dir
+		}
+		res = append(res, de)
+	}
+	return res, nil
+}
+
+var _ = fs.NodeStringLookuper(&ReadOnlyDir{})
+
+func (d *ReadOnlyDir) Lookup(c context.Context, name string) (n fs.Node, err error) {
+	defer d.fs.stats.fuseOp("Lookup", time.Now(), &err)
+
+	b := NewStrictDirLike(d.fs.db.store, d.path, d.fs.db.Handler)
+	stat, err := b.Stat(name)
+	if err != nil {
+		return nil, errno(err)
+	}
+	child := append(append([]string{}, d.path...), name)
+	if stat.Dir {
+		return &ReadOnlyDir{fs: d.fs, path: child, value: d.value}, nil
+	}
+	return &ReadOnlyFile{fs: d.fs, path: child, value: d.value}, nil
+}
+
+// ReadOnlyFile is a file of a ReadOnlyDir.
+type ReadOnlyFile struct {
+	fs *FS
+	// absolute path
+	path  []string
+	value func([]byte) []byte
+}
+
+var _ = fs.Node(&ReadOnlyFile{})
+
+func (f *ReadOnlyFile) content() ([]byte, error) {
+	kv, err := f.fs.db.store.Get(filepath.Join(f.path...))
+	if err != nil {
+		return nil, errno(err)
+	}
+	if f.value == nil {
+		return kv.Value, nil
+	}
+	return f.value(kv.Value), nil
+}
+
+func (f *ReadOnlyFile) Attr(c context.Context, a *fuse.Attr) error {
+	a.Inode = inode(filepath.Join(f.path...))
+	a.Mode = 0444
+	if v, err := f.content(); err == nil {
+		a.Size = uint64(len(v))
+	}
+	return nil
+}
+
+var _ = fs.NodeOpener(&ReadOnlyFile{})
+
+func (f *ReadOnlyFile) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	return f, nil
+}
+
+var _ = fs.HandleReader(&ReadOnlyFile{})
+
+func (f *ReadOnlyFile) Read(c context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer f.fs.stats.fuseOp("Read", time.Now(), &err)
+
+	v, err := f.content()
+	if err != nil {
+		return err
+	}
+	fuseutil.HandleRead(req, resp, v)
+	return nil
+}
@@ -0,0 +1,336 @@
+package kvfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"github.com/docker/libkv/store"
+	"golang.org/x/net/context"
+)
+
+const (
+	// A key ending with this suffix is a template.  It's exposed as-is, plus a rendered virtual
+	// file with the suffix removed, e.g. nginx.conf.tmpl renders to nginx.conf.
+	TemplateSuffix = ".tmpl"
+)
+
+// Render executes the template stored at key in the given directory (relative to the backend root).
+// Keys referenced in the template are resolved through the Context / DirLike api.  Absolute paths
+// like "/app/port" are relative to the backend root; relative paths are relative to the
+// template's directory.
+func Render(ctx Context, dir []string, key string) ([]byte, error) {
+	out, _, err := render(ctx, dir, key)
+	return out, err
+}
+
+// render returns the output along with the keys and directories that were read during
+// the render, so that callers can watch them for changes.
+func render(ctx Context, dir []string, key string) ([]byte, *renderDeps, error) {
+	src := ctx.Dir(dir).Get(key)
+	if src == nil {
+		return nil, nil, fuse.ENOENT
+	}
+	deps := &renderDeps{keys: map[string]bool{}, dirs: map[string]bool{}}
+	deps.keys[filepath.Join(append(dir, key)...)] = true
+
+	resolve := func(p string) ([]string, string) {
+		var full []string
+		if path.IsAbs(p) {
+			full = splitPath(p)
+		} else {
+			full = append(append([]string{}, dir...), splitPath(p)...)
+		}
+		if len(full) == 0 {
+			return nil, ""
+		}
+		return full[:len(full)-1], full[len(full)-1]
+	}
+	resolveDir := func(p string) []string {
+		if path.IsAbs(p) {
+			return splitPath(p)
+		}
+		return append(append([]string{}, dir...), splitPath(p)...)
+	}
+
+	funcs := template.FuncMap{
+		"get": func(p string) (string, error) {
+			parent, name := resolve(p)
+			deps.keys[filepath.Join(append(parent, name)...)] = true
+			v := ctx.Dir(parent).Get(name)
+			if v == nil {
+				return "", &ErrTemplateKey{p}
+			}
+			return string(v), nil
+		},
+		"getd": func(p, def string) string {
+			parent, name := resolve(p)
+			deps.keys[filepath.Join(append(parent, name)...)] = true
+			if v := ctx.Dir(parent).Get(name); v != nil {
+				return string(v)
+			}
+			return def
+		},
+		"exists": func(p string) bool {
+			parent, name := resolve(p)
+			deps.keys[filepath.Join(append(parent, name)...)] = true
+			if ctx.Dir(parent).Get(name) != nil {
+				return true
+			}
+			return ctx.Dir(parent).Dir(name) != nil
+		},
+		"ls": func(p string) ([]string, error) {
+			return listNames(ctx, resolveDir(p), deps, false)
+		},
+		"lsdir": func(p string) ([]string, error) {
+			return listNames(ctx, resolveDir(p), deps, true)
+		},
+		"json": func(v string) (interface{}, error) {
+			var out interface{}
+			err := json.Unmarshal([]byte(v), &out)
+			return out, err
+		},
+		"split":    strings.Split,
+		"join":     strings.Join,
+		"trim":     strings.TrimSpace,
+		"toUpper":  strings.ToUpper,
+		"toLower":  strings.ToLower,
+		"contains": strings.Contains,
+		"replace":  strings.Replace,
+		"base":     path.Base,
+		"dir":      path.Dir,
+	}
+
+	t, err := template.New(key).Funcs(funcs).Parse(string(src))
+	if err != nil {
+		return nil, deps, err
+	}
+	buff := new(bytes.Buffer)
+	if err := t.Execute(buff, nil); err != nil {
+		return nil, deps, err
+	}
+	return buff.Bytes(), deps, nil
+}
+
+func listNames(ctx Context, p []string, deps *renderDeps, dirsOnly bool) ([]string, error) {
+	deps.dirs[filepath.Join(p...)] = true
+	names := []string{}
+	for entry := range ctx.Dir(p).Cursor() {
+		if entry.Err != nil {
+			return nil, entry.Err
+		}
+		if dirsOnly && !entry.Dir {
+			continue
+		}
+		names = append(names, entry.Key)
+	}
+	// Backends don't agree on the listing order, so sort for a stable render.
+	sort.Strings(names)
+	return names, nil
+}
+
+func splitPath(p string) []string {
+	parts := []string{}
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return parts
+}
+
+// Keys and directories (relative to the backend root) read while rendering a template.
+type renderDeps struct {
+	keys map[string]bool
+	dirs map[string]bool
+}
+
+// renderer caches the output of a template until one of the keys it depends on changes.
+type renderer struct {
+	fs   *FS
+	dir  []string
+	key  string
+	mu   sync.Mutex
+	out  []byte
+	err  error
+	stop chan struct{}
+}
+
+func (r *renderer) get(c context.Context) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil {
+		r.fs.stats.cacheHit()
+		return r.out, r.err
+	}
+	r.fs.stats.cacheMiss()
+	var deps *renderDeps
+	r.fs.db.View(c, func(ctx Context) error {
+		r.out, deps, r.err = render(ctx, r.dir, r.key)
+		return nil
+	})
+	if deps != nil && r.watch(deps) {
+		// Cache only if we are able to watch every dependency.
+		return r.out, r.err
+	}
+	out, err := r.out, r.err
+	r.invalidate()
+	return out, err
+}
+
+// watch starts watches on all the dependencies.  Must be called with the lock held.
+func (r *renderer) watch(deps *renderDeps) bool {
+	stop := make(chan struct{})
+	events := []<-chan struct{}{}
+	root := filepath.Join(r.fs.db.Root...)
+	s := r.fs.db.store
+	for k := range deps.keys {
+		ch, err := s.Watch(filepath.Join(root, k), stop)
+		if err != nil {
+			close(stop)
+			return false
+		}
+		events = append(events, keyChanged(ch))
+	}
+	for d := range deps.dirs {
+		ch, err := s.WatchTree(filepath.Join(root, d), stop)
+		if err != nil {
+			close(stop)
+			return false
+		}
+		events = append(events, treeChanged(ch))
+	}
+	r.stop = stop
+	for _, ev := range events {
+		go func(ev <-chan struct{}) {
+			select {
+			case <-ev:
+				r.mu.Lock()
+				if r.stop == stop {
+					r.invalidate()
+				}
+				r.mu.Unlock()
+			case <-stop:
+			}
+		}(ev)
+	}
+	return true
+}
+
+// invalidate drops the cached output and stops the watches.  Must be called with the lock held.
+func (r *renderer) invalidate() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+	r.stop = nil
+	r.out = nil
+	r.err = nil
+}
+
+// keyChanged returns a channel that is closed at the first change of a watched key.  libkv pushes
+// the current value as the first event of a watch, so that one is skipped.
+func keyChanged(in <-chan *store.KVPair) <-chan struct{} {
+	out := make(chan struct{})
+	go func() {
+		<-in
+		if _, ok := <-in; ok {
+			close(out)
+		}
+	}()
+	return out
+}
+
+// treeChanged is keyChanged for WatchTree.
+func treeChanged(in <-chan []*store.KVPair) <-chan struct{} {
+	out := make(chan struct{})
+	go func() {
+		<-in
+		if _, ok := <-in; ok {
+			close(out)
+		}
+	}()
+	return out
+}
+
+type templates struct {
+	fs        *FS
+	mu        sync.Mutex
+	renderers map[string]*renderer
+}
+
+func (t *templates) renderer(dir []string, key string) *renderer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := filepath.Join(append(dir, key)...)
+	if r, has := t.renderers[p]; has {
+		return r
+	}
+	r := &renderer{fs: t.fs, dir: append([]string{}, dir...), key: key}
+	t.renderers[p] = r
+	return r
+}
+
+func (t *templates) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range t.renderers {
+		r.mu.Lock()
+		r.invalidate()
+		r.mu.Unlock()
+	}
+}
+
+// TemplateFile is the read-only rendered output of a template key.
+type TemplateFile struct {
+	dir      *Dir
+	name     string
+	renderer *renderer
+}
+
+var _ = fs.Node(&TemplateFile{})
+var _ = fs.Handle(&TemplateFile{})
+
+func (f *TemplateFile) Attr(c context.Context, a *fuse.Attr) error {
+	a.Inode = inode(f.dir.key(f.name))
+	a.Mode = 0444
+	if out, err := f.renderer.get(c); err == nil {
+		a.Size = uint64(len(out))
+	}
+	return nil
+}
+
+var _ = fs.NodeOpener(&TemplateFile{})
+
+func (f *TemplateFile) Open(c context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	// The render can change at any time, so don't let the kernel cache pages.
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+var _ = fs.HandleReader(&TemplateFile{})
+
+func (f *TemplateFile) Read(c context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer f.dir.fs.stats.fuseOp("Read", time.Now(), &err)
+
+	out, err := f.renderer.get(c)
+	if err != nil {
+		return err
+	}
+	fuseutil.HandleRead(req, resp, out)
+	return nil
+}
@@ -0,0 +1,262 @@
+package kvfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+const (
+	// How often the trash is purged by a mount
+	trashPurgeInterval = time.Minute
+	// Ids of the trash entries, which sort by time
+	trashIdFormat = "20060102T150405.000000000Z"
+)
+
+// TrashEntry is a file or directory that was moved to the trash.  The copy is in the system
+// directory at trash/<id>/<path>, and the entry at trash-manifests/<id>.
+type TrashEntry struct {
+	Id string `json:"id"`
+	// Path below the root, e.g. /app/config.yaml
+	Path  string    `json:"path"`
+	Dir   bool      `json:"dir,omitempty"`
+	Time  time.Time `json:"time"`
+	Uid   uint32    `json:"uid"`
+	Keys  int       `json:"keys"`
+	Bytes int       `json:"bytes"`
+}
+
+func (this *Backend) trashManifest(id string) string {
+	return filepath.Join(this.systemPath("trash-manifests", id)...)
+}
+
+// Trash moves the file or directory at path below the root to the trash.
+func (this *Backend) Trash(path []string, uid uint32) (*TrashEntry, error) {
+	if len(path) == 0 {
+		return nil, &ErrNotFound{filepath.Join(this.Root...)}
+	}
+	parentPath, name := path[:len(path)-1], path[len(path)-1]
+	parent := NewStrictDirLike(this.store, append(append([]string{}, this.Root...), parentPath...), this.Handler)
+	stat, err := parent.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	e := &TrashEntry{
+		Id:   now.UTC().Format(trashIdFormat),
+		Path: "/" + filepath.Join(path...),
+		Dir:  stat.Dir,
+		Time: now,
+		Uid:  uid,
+	}
+	to, err := NewStrictDirLike(this.store, this.systemPath("trash"), this.Handler).CreateDir(e.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range parentPath {
+		if to, err = to.CreateDir(elem); err != nil {
+			return nil, err
+		}
+	}
+
+	if stat.Dir {
+		from, err := parent.Dir(name)
+		if err != nil {
+			return nil, err
+		}
+		toDir, err := to.CreateDir(name)
+		if err != nil {
+			return nil, err
+		}
+		err = copyTree(from, toDir, "", func(rel string, kv *store.KVPair) {
+			if kv != nil {
+				e.Keys++
+				e.Bytes += len(kv.Value)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		kv, err := parent.GetPair(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := to.Put(name, kv.Value); err != nil {
+			return nil, err
+		}
+		e.Keys, e.Bytes = 1, len(kv.Value)
+	}
+
+	// The entry is written before the original is deleted, so nothing is lost if that fails.
+	buff, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.store.Put(this.trashManifest(e.Id), buff, nil); err != nil {
+		return nil, err
+	}
+	if stat.Dir {
+		return e, parent.DeleteDir(name)
+	}
+	return e, parent.Delete(name)
+}
+
+// TrashEntries returns the entries of the trash, oldest first.
+func (this *Backend) TrashEntries() ([]*TrashEntry, error) {
+	list, err := this.store.List(filepath.Join(this.systemPath("trash-manifests")...))
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []*TrashEntry{}
+	for _, kv := range list {
+		e := &TrashEntry{}
+		if err := json.Unmarshal(kv.Value, e); err != nil {
+			continue
+		}
+		out = append(out, e)
+	}
+	sort.Sort(trashById(out))
+	return out, nil
+}
+
+// TrashEntry returns an entry of the trash by id.
+func (this *Backend) TrashEntry(id string) (*TrashEntry, error) {
+	kv, err := this.store.Get(this.trashManifest(id))
+	if err == store.ErrKeyNotFound {
+		return nil, &ErrNotFound{id}
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &TrashEntry{}
+	return e, json.Unmarshal(kv.Value, e)
+}
+
+// RestoreTrash moves an entry of the trash back to where it was.  It returns *ErrConflict if
+// something has been created at the path since.
+func (this *Backend) RestoreTrash(id string) (*TrashEntry, error) {
+	e, err := this.TrashEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	path := relPath(e.Path)
+	if len(path) == 0 {
+		return nil, &ErrNotFound{e.Path}
+	}
+	parentPath, name := path[:len(path)-1], path[len(path)-1]
+
+	from := NewStrictDirLike(this.store, this.systemPath("trash", id), this.Handler)
+	to := NewStrictDirLike(this.store, append([]string{}, this.Root...), this.Handler)
+	for _, elem := range parentPath {
+		if from, err = from.Dir(elem); err != nil {
+			return nil, err
+		}
+		if _, err := to.Stat(elem); err != nil {
+			if _, is := err.(*ErrNotFound); !is {
+				return nil, err
+			}
+			if to, err = to.CreateDir(elem); err != nil {
+				return nil, err
+			}
+		} else if to, err = to.Dir(elem); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := to.Stat(name); err == nil {
+		return nil, &ErrConflict{e.Path}
+	} else if _, is := err.(*ErrNotFound); !is {
+		return nil, err
+	}
+
+	if e.Dir {
+		fromDir, err := from.Dir(name)
+		if err != nil {
+			return nil, err
+		}
+		toDir, err := to.CreateDir(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := copyTree(fromDir, toDir, "", func(string, *store.KVPair) {}); err != nil {
+			return nil, err
+		}
+	} else {
+		v, err := from.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := to.AtomicPut(name, v, nil); err != nil {
+			return nil, err
+		}
+	}
+	return e, this.DeleteTrash(id)
+}
+
+// DeleteTrash deletes an entry of the trash for good.
+func (this *Backend) DeleteTrash(id string) error {
+	trash := NewStrictDirLike(this.store, this.systemPath("trash"), this.Handler)
+	if err := trash.DeleteDir(id); err != nil {
+		if _, is := err.(*ErrNotFound); !is {
+			return err
+		}
+	}
+	return this.store.Delete(this.trashManifest(id))
+}
+
+// PurgeTrash deletes the entries older than retention, then the oldest entries until the trash
+// holds at most maxBytes.  A zero retention or maxBytes is no limit.  It returns the deleted entries.
+func (this *Backend) PurgeTrash(retention time.Duration, maxBytes uint64) ([]*TrashEntry, error) {
+	entries, err := this.TrashEntries()
+	if err != nil {
+		return nil, err
+	}
+	total := uint64(0)
+	for _, e := range entries {
+		total += uint64(e.Bytes)
+	}
+	purged := []*TrashEntry{}
+	for _, e := range entries {
+		expired := retention > 0 && time.Since(e.Time) > retention
+		if !expired && (maxBytes == 0 || total <= maxBytes) {
+			continue
+		}
+		if err := this.DeleteTrash(e.Id); err != nil {
+			return purged, err
+		}
+		total -= uint64(e.Bytes)
+		purged = append(purged, e)
+	}
+	return purged, nil
+}
+
+// purgeTrash purges the trash of the mount every trashPurgeInterval, until the mount is stopped.
+func (f *FS) purgeTrash() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := f.db.PurgeTrash(f.trashRetention, f.trashMaxBytes); err != nil {
+				fmt.Fprintln(os.Stderr, "Cannot purge the trash. Err=", err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+type trashById []*TrashEntry
+
+func (l trashById) Len() int           { return len(l) }
+func (l trashById) Less(i, j int) bool { return l[i].Id < l[j].Id }
+func (l trashById) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
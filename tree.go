@@ -0,0 +1,76 @@
+package kvfs
+
+import (
+	"fmt"
+	net "net/url"
+	"strings"
+)
+
+// OpenPath opens the kv store of the url at the root a mount of it would use, for working on the
+// tree without a mount, and returns the path of the url below that root.  The root is the given
+// path if it's not empty, or else the closest parent of the url path with a system directory, or
+// else the top of the kv store.  The root decides which trash and quotas apply.  Paths with
+// reserved names are refused.
+func OpenPath(url, root string, config *Config) (*Backend, []string, error) {
+	u, err := net.Parse(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	path := relPath(u.Path)
+	for _, elem := range path {
+		if IsMarker(elem) {
+			return nil, nil, fmt.Errorf("%s is reserved", elem)
+		}
+	}
+
+	at := 0
+	if root != "" {
+		prefix := relPath(root)
+		if len(prefix) > len(path) || strings.Join(prefix, "/") != strings.Join(path[:len(prefix)], "/") {
+			return nil, nil, fmt.Errorf("%s is not below the root %s", u.Path, root)
+		}
+		at = len(prefix)
+	} else {
+		u.Path = ""
+		top, err := NewBackend(u.String(), config)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := len(path) - 1; i > 0; i-- {
+			if stat, err := top.Context(nil).StrictDir(path[:i]).Stat(SystemDir); err == nil && stat.Dir {
+				at = i
+				break
+			}
+		}
+		top.store.Close()
+	}
+	u.Path = ""
+	if at > 0 {
+		u.Path = "/" + strings.Join(path[:at], "/")
+	}
+	backend, err := NewBackend(u.String(), config)
+	return backend, path[at:], err
+}
+
+// MkdirAll creates the directories of the path below the root that don't exist, like mkdir -p,
+// within the quotas.
+func (this *Backend) MkdirAll(path []string) error {
+	q := newQuotas(this)
+	dir := this.Context(nil).StrictDir([]string{})
+	for i, elem := range path {
+		child, err := dir.Dir(elem)
+		if _, is := err.(*ErrNotFound); is {
+			if err = q.checkEntries(path[:i]); err != nil {
+				return err
+			}
+			if child, err = dir.CreateDir(elem); err == nil {
+				q.charge(path[:i], 0, 1, 0)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		dir = child
+	}
+	return nil
+}
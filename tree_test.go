@@ -0,0 +1,44 @@
+package kvfs
+
+import (
+	. "gopkg.in/check.v1"
+	"strings"
+)
+
+type TestSuiteTree struct{}
+
+var _ = Suite(&TestSuiteTree{})
+
+func (suite *TestSuiteTree) TestRelPath(c *C) {
+	for _, t := range []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"/", []string{}},
+		{"//", []string{}},
+		{".", []string{}},
+		{"/app", []string{"app"}},
+		{"app/db/", []string{"app", "db"}},
+		{"/app//db/host", []string{"app", "db", "host"}},
+		{"/app/./db", []string{"app", "db"}},
+		{"/app/tmp/../db", []string{"app", "db"}},
+	} {
+		c.Assert(relPath(t.in), DeepEquals, t.want, Commentf(t.in))
+	}
+	c.Assert(relPath("app", "db", "host"), DeepEquals, strings.Split("app/db/host", "/"))
+}
+
+func (suite *TestSuiteTree) TestOpenPathReserved(c *C) {
+	for _, url := range []string{
+		"zk://localhost:2181/app/" + SystemDir + "/trash",
+		"zk://localhost:2181/app/" + DirMarker,
+	} {
+		_, _, err := OpenPath(url, "", nil)
+		c.Assert(err, ErrorMatches, ".* is reserved", Commentf(url))
+	}
+	_, _, err := OpenPath("zk://localhost:2181/app/db", "/other", nil)
+	c.Assert(err, ErrorMatches, "/app/db is not below the root /other")
+	_, _, err = OpenPath("zk://localhost:2181/app", "/app/db", nil)
+	c.Assert(err, ErrorMatches, "/app is not below the root /app/db")
+}
@@ -0,0 +1,437 @@
+package kvfs
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/libkv/store"
+	net "net/url"
+)
+
+// NewUnionBackend layers the kv stores at urls, top first.  Keys are read from the first layer
+// that has them and directory listings merge all the layers.  Writes go to the top layer.  When
+// a key that's also in a lower layer is deleted, a whiteout marker (~wh~<name>) is written next
+// to it in the top layer, which hides the key and anything below it in the lower layers.
+func NewUnionBackend(urls []string, c *Config) (*Backend, error) {
+	if len(urls) == 0 {
+		return nil, &ErrNotSupported{"union of no urls"}
+	}
+	if len(urls) == 1 {
+		return NewBackend(urls[0], c)
+	}
+	parsed := []*net.URL{}
+	union := &unionStore{}
+	for _, url := range urls {
+		u, err := net.Parse(url)
+		if err != nil {
+			return nil, err
+		}
+		s, h, err := GetStore(u, storeConfig(u, c))
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, u)
+		union.layers = append(union.layers, &unionLayer{store: s, handler: h, root: strings.Trim(rootOf(u), "/")})
+	}
+	union.root = union.layers[0].root
+
+	top := union.layers[0].handler
+	h := &Handler{
+		NameFromKey: func(parent string, key string) (name string) {
+			// The union returns the path, without the leading '/'.
+			return strings.Split(strings.TrimPrefix(key, strings.Trim(parent, "/")+"/"), "/")[0]
+		},
+		PathFromKey: func(parent string, key string) (path string) {
+			return key
+		},
+		DeleteEmptyParent: func(store store.Store, key string) error {
+			return store.DeleteTree(key)
+		},
+		// Entry by entry would leave a whiteout for each entry of the lower layers.
+		DeleteDir: func(store store.Store, key string) error {
+			return store.DeleteTree(key)
+		},
+		MaxValueSize: top.MaxValueSize,
+	}
+	backend := newBackend(parsed[0], union, h, c)
+	backend.lower = parsed[1:]
+	return backend, nil
+}
+
+type unionLayer struct {
+	store   store.Store
+	handler *Handler
+	// root of the url, which the layer's keys are below
+	root string
+}
+
+// deleteTree deletes the key and everything below it.  zk only deletes keys without children, so
+// the children are deleted first if the key can't be deleted.
+func (this *unionLayer) deleteTree(key string) error {
+	err := this.handler.DeleteEmptyParent(this.store, key)
+	if err == nil || err == store.ErrKeyNotFound {
+		return err
+	}
+	list, lerr := this.store.List(key)
+	if lerr == store.ErrKeyNotFound {
+		return err
+	}
+	if lerr != nil {
+		return lerr
+	}
+	for _, kv := range list {
+		if err := this.deleteTree(this.handler.PathFromKey(key, kv.Key)); err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+	}
+	return this.handler.DeleteEmptyParent(this.store, key)
+}
+
+// unionStore implements store.Store over the layers.  Keys are paths below the root of the top
+// layer, like for any other store, and are moved below the root of each lower layer.  List
+// returns the paths of the keys, without the leading '/'.
+type unionStore struct {
+	root   string
+	layers []*unionLayer
+}
+
+var _ = store.Store(&unionStore{})
+
+// key returns the key of the i-th layer.
+func (this *unionStore) key(i int, key string) string {
+	key = strings.Trim(key, "/")
+	rel := key
+	switch {
+	case key == this.root:
+		rel = ""
+	case this.root != "" && strings.HasPrefix(key, this.root+"/"):
+		rel = key[len(this.root)+1:]
+	}
+	return strings.Trim(filepath.Join(this.layers[i].root, rel), "/")
+}
+
+func whiteout(key string) string {
+	key = strings.Trim(key, "/")
+	return filepath.Join(filepath.Dir(key), WhiteoutPrefix+filepath.Base(key))
+}
+
+// whited returns true if the key, or a directory above it, has a whiteout in the top layer.
+// Whiteouts only hide the lower layers.
+func (this *unionStore) whited(key string) (bool, error) {
+	for p := strings.Trim(key, "/"); p != "" && p != "." && p != this.root; p = filepath.Dir(p) {
+		if exists, err := this.layers[0].store.Exists(whiteout(p)); err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// lookup returns the value of the key from the first layer that has it, and the layer.
+func (this *unionStore) lookup(key string) (*store.KVPair, int, error) {
+	for i, l := range this.layers {
+		if i == 1 {
+			if whited, err := this.whited(key); err != nil {
+				return nil, -1, err
+			} else if whited {
+				break
+			}
+		}
+		kv, err := l.store.Get(this.key(i, key))
+		if err == store.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, -1, err
+		}
+		return &store.KVPair{Key: strings.Trim(key, "/"), Value: kv.Value, LastIndex: kv.LastIndex}, i, nil
+	}
+	return nil, -1, store.ErrKeyNotFound
+}
+
+// lowerHas returns true if a lower layer has the key or keys below it that aren't whited out.
+func (this *unionStore) lowerHas(key string) (bool, error) {
+	if whited, err := this.whited(key); err != nil || whited {
+		return false, err
+	}
+	for i := 1; i < len(this.layers); i++ {
+		s := this.layers[i].store
+		if exists, err := s.Exists(this.key(i, key)); err != nil || exists {
+			return exists, err
+		}
+		// consul and etcd have no key for a directory
+		list, err := s.List(this.key(i, key))
+		if err != nil && err != store.ErrKeyNotFound {
+			return false, err
+		}
+		if len(list) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (this *unionStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	return this.layers[0].store.Put(key, value, options)
+}
+
+func (this *unionStore) Get(key string) (*store.KVPair, error) {
+	kv, _, err := this.lookup(key)
+	return kv, err
+}
+
+// Delete deletes the key from the top layer and hides it in the lower layers.
+func (this *unionStore) Delete(key string) error {
+	return this.delete(key, this.layers[0].store.Delete)
+}
+
+// DeleteTree deletes the subtree from the top layer, with the whiteouts in it, and hides it in
+// the lower layers with a single whiteout.
+func (this *unionStore) DeleteTree(key string) error {
+	return this.delete(key, this.layers[0].deleteTree)
+}
+
+func (this *unionStore) delete(key string, del func(string) error) error {
+	err := del(key)
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	lower, lerr := this.lowerHas(key)
+	if lerr != nil {
+		return lerr
+	}
+	if !lower {
+		return err
+	}
+	return this.layers[0].store.Put(whiteout(key), []byte{1}, nil) // etcd won't write zero byte records
+}
+
+func (this *unionStore) Exists(key string) (bool, error) {
+	_, _, err := this.lookup(key)
+	if err == store.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List merges the listings of the layers.  Keys in upper layers hide the same keys in lower
+// layers, and whiteouts hide the keys below them.
+func (this *unionStore) List(directory string) ([]*store.KVPair, error) {
+	directory = strings.Trim(directory, "/")
+	seen := map[string]bool{}
+	hidden := map[string]bool{}
+	isHidden := func(rel string) bool {
+		for p := rel; p != "." && p != ""; p = filepath.Dir(p) {
+			if hidden[p] {
+				return true
+			}
+		}
+		return false
+	}
+
+	found := false
+	out := []*store.KVPair{}
+	for i, l := range this.layers {
+		if i == 1 {
+			if whited, err := this.whited(directory); err != nil {
+				return nil, err
+			} else if whited {
+				break
+			}
+		}
+		parent := this.key(i, directory)
+		list, err := l.store.List(parent)
+		if err == store.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, kv := range list {
+			p := strings.Trim(l.handler.PathFromKey(parent, kv.Key), "/")
+			rel := strings.Trim(strings.TrimPrefix(p, parent), "/")
+			name := filepath.Base(rel)
+			if strings.HasPrefix(name, WhiteoutPrefix) {
+				if i == 0 {
+					hidden[filepath.Join(filepath.Dir(rel), strings.TrimPrefix(name, WhiteoutPrefix))] = true
+				}
+				continue
+			}
+			key := strings.Trim(filepath.Join(directory, rel), "/")
+			if seen[key] || (i > 0 && isHidden(rel)) {
+				continue
+			}
+			seen[key] = true
+			out = append(out, &store.KVPair{Key: key, Value: kv.Value, LastIndex: kv.LastIndex})
+		}
+	}
+	if !found {
+		return nil, store.ErrKeyNotFound
+	}
+	return out, nil
+}
+
+// watch watches every layer and calls read when any of them changes.  done is called when the
+// watch of any layer is lost, to close the channel so the caller watches again.
+func (this *unionStore) watch(stop <-chan struct{}, watch func(i int) (<-chan struct{}, error), read, done func()) error {
+	events := make(chan struct{})
+	lost := make(chan struct{})
+	var once sync.Once
+	for i := range this.layers {
+		ch, err := watch(i)
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			// e.g. the directory doesn't exist in this layer
+			continue
+		}
+		go func() {
+			for range ch {
+				select {
+				case events <- struct{}{}:
+				case <-stop:
+					return
+				}
+			}
+			once.Do(func() { close(lost) })
+		}()
+	}
+	go func() {
+		defer done()
+		for {
+			select {
+			case <-events:
+				read()
+			case <-lost:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (this *unionStore) Watch(key string, stop <-chan struct{}) (<-chan *store.KVPair, error) {
+	out := make(chan *store.KVPair)
+	err := this.watch(stop,
+		func(i int) (<-chan struct{}, error) {
+			ch, err := this.layers[i].store.Watch(this.key(i, key), stop)
+			if err != nil {
+				return nil, err
+			}
+			events := make(chan struct{})
+			go func() {
+				defer close(events)
+				for range ch {
+					select {
+					case events <- struct{}{}:
+					case <-stop:
+						return
+					}
+				}
+			}()
+			return events, nil
+		},
+		func() {
+			if kv, _, err := this.lookup(key); err == nil {
+				select {
+				case out <- kv:
+				case <-stop:
+				}
+			}
+		},
+		func() { close(out) })
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (this *unionStore) WatchTree(directory string, stop <-chan struct{}) (<-chan []*store.KVPair, error) {
+	out := make(chan []*store.KVPair)
+	err := this.watch(stop,
+		func(i int) (<-chan struct{}, error) {
+			ch, err := this.layers[i].store.WatchTree(this.key(i, directory), stop)
+			if err != nil {
+				return nil, err
+			}
+			events := make(chan struct{})
+			go func() {
+				defer close(events)
+				for range ch {
+					select {
+					case events <- struct{}{}:
+					case <-stop:
+						return
+					}
+				}
+			}()
+			return events, nil
+		},
+		func() {
+			if list, err := this.List(directory); err == nil {
+				select {
+				case out <- list:
+				case <-stop:
+				}
+			}
+		},
+		func() { close(out) })
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (this *unionStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return this.layers[0].store.NewLock(key, options)
+}
+
+// AtomicPut checks previous against the layer the key is read from, and writes to the top layer.
+func (this *unionStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	kv, i, err := this.lookup(key)
+	if err != nil && err != store.ErrKeyNotFound {
+		return false, nil, err
+	}
+	top := this.layers[0].store
+	switch {
+	case previous == nil && err == nil:
+		return false, nil, store.ErrKeyExists
+	case previous == nil:
+		return top.AtomicPut(key, value, nil, options)
+	case err != nil:
+		return false, nil, store.ErrKeyNotFound
+	case i == 0:
+		return top.AtomicPut(key, value, previous, options)
+	case kv.LastIndex != previous.LastIndex:
+		return false, nil, store.ErrKeyModified
+	}
+	return top.AtomicPut(key, value, nil, options)
+}
+
+func (this *unionStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	kv, i, err := this.lookup(key)
+	if err != nil {
+		return false, err
+	}
+	if i == 0 {
+		if _, err := this.layers[0].store.AtomicDelete(key, previous); err != nil {
+			return false, err
+		}
+	} else if previous == nil || kv.LastIndex != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	if err := this.delete(key, func(string) error { return nil }); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (this *unionStore) Close() {
+	for _, l := range this.layers {
+		l.store.Close()
+	}
+}
@@ -0,0 +1,4 @@
+package kvfs
+
+// Version of kvfs.  Set at build time with -ldflags "-X github.com/conductant/kvfs.Version=..."
+var Version = "dev"
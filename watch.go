@@ -0,0 +1,259 @@
+package kvfs
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Change is an add, update or delete of a key found below a watched path.
+type Change struct {
+	// Path of the key relative to the backend root, e.g. /app/port.  Directory markers
+	// are reported as the directory itself with Dir set.
+	Key   string    `json:"key"`
+	Dir   bool      `json:"dir,omitempty"`
+	Op    string    `json:"op"`
+	Index uint64    `json:"index"`
+	Time  time.Time `json:"timestamp"`
+}
+
+type snapshotEntry struct {
+	index uint64
+	sum   uint64
+}
+
+// walk calls fn for every key in the tree below p, including directory markers but not the
+// system directory.  It lists every directory because only consul returns all the descendants in
+// a List.
+func (this *Backend) walk(p string, fn func(path string, kv *store.KVPair)) error {
+	seen := map[string]bool{}
+	var walk func(string) error
+	walk = func(parent string) error {
+		list, err := this.store.List(parent)
+		if err == store.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, kv := range list {
+			child := this.Handler.PathFromKey(parent, kv.Key)
+			below := strings.TrimPrefix(strings.TrimPrefix(child, "/"), strings.Trim(p, "/"))
+			if seen[child] || strings.Contains("/"+below+"/", "/"+SystemDir+"/") {
+				continue
+			}
+			seen[child] = true
+			fn(child, kv)
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(p)
+}
+
+// snapshot walks the tree below p and records the index and a checksum of every key.
+func (this *Backend) snapshot(p string) (map[string]snapshotEntry, error) {
+	out := map[string]snapshotEntry{}
+	err := this.walk(p, func(child string, kv *store.KVPair) {
+		h := fnv.New64a()
+		h.Write(kv.Value)
+		out[child] = snapshotEntry{index: kv.LastIndex, sum: h.Sum64()}
+	})
+	return out, err
+}
+
+func (this *Backend) diff(before, after map[string]snapshotEntry, now time.Time) []*Change {
+	root := filepath.Join(this.Root...)
+	rel := func(p string) (string, bool) {
+		p = "/" + strings.TrimPrefix(strings.TrimPrefix(p, "/"), root)
+		p = filepath.Clean(p)
+		if filepath.Base(p) == DirMarker {
+			return filepath.Dir(p), true
+		}
+		return p, false
+	}
+	changes := []*Change{}
+	for k, v := range after {
+		if prev, has := before[k]; has && prev == v {
+			continue
+		}
+		key, dir := rel(k)
+		changes = append(changes, &Change{Key: key, Dir: dir, Op: OpPut, Index: v.index, Time: now})
+	}
+	for k, v := range before {
+		if _, has := after[k]; !has {
+			key, dir := rel(k)
+			changes = append(changes, &Change{Key: key, Dir: dir, Op: OpDelete, Index: v.index, Time: now})
+		}
+	}
+	sort.Sort(changeList(changes))
+	return changes
+}
+
+type changeList []*Change
+
+func (l changeList) Len() int           { return len(l) }
+func (l changeList) Less(i, j int) bool { return l[i].Key < l[j].Key }
+func (l changeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Changes watches the tree below path (relative to the backend root) and sends the keys that
+// changed since the last notification.  If the watch is lost, e.g. because of a session loss, it
+// is re-established and the changes made in the meantime are reported.  Note that zookeeper
+// only notifies when the direct children of path are added or removed.
+func (this *Backend) Changes(path []string, stop <-chan struct{}) (<-chan []*Change, error) {
+	p := filepath.Join(append(append([]string{}, this.Root...), path...)...)
+	current, err := this.snapshot(p)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan []*Change)
+	go func() {
+		defer close(out)
+		wait := time.Second
+		for {
+			watch, err := this.store.WatchTree(p, stop)
+			if err == nil {
+				wait = time.Second
+				for range watch {
+					next, err := this.snapshot(p)
+					if err != nil {
+						break
+					}
+					changes := this.diff(current, next, time.Now())
+					current = next
+					if len(changes) == 0 {
+						continue
+					}
+					select {
+					case out <- changes:
+					case <-stop:
+						return
+					}
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+				if wait < time.Minute {
+					wait = wait * 2
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// HookConfig configures what to run when keys change.  If Func is set, it's called instead of
+// running Command.
+type HookConfig struct {
+	// Command is run with sh -c.  The changed keys are passed in the environment as
+	// KVFS_CHANGED_KEYS (space separated) and on stdin as one 'op key' line per change.
+	Command string
+	Func    func([]*Change) error
+
+	// Changes are collected until there are none for this long before the hook runs.
+	Debounce time.Duration
+	// Number of retries of a failed hook, waiting RetryWait, then twice as long, etc. in between.
+	Retries   int
+	RetryWait time.Duration
+
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Hook runs the hook whenever keys below path (relative to the backend root) change.
+// It blocks until stop is closed.
+func (this *Backend) Hook(path []string, config *HookConfig, stop <-chan struct{}) error {
+	changes, err := this.Changes(path, stop)
+	if err != nil {
+		return err
+	}
+	pending := map[string]*Change{}
+	var fire <-chan time.Time
+	for {
+		select {
+		case batch, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			for _, c := range batch {
+				pending[c.Key] = c
+			}
+			fire = time.After(config.Debounce)
+		case <-fire:
+			batch := []*Change{}
+			for _, c := range pending {
+				batch = append(batch, c)
+			}
+			sort.Sort(changeList(batch))
+			pending = map[string]*Change{}
+			fire = nil
+			if err := config.run(batch, stop); err != nil {
+				fmt.Fprintln(config.stderr(), "Hook failed. Err=", err)
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (this *HookConfig) run(batch []*Change, stop <-chan struct{}) (err error) {
+	wait := this.RetryWait
+	for attempt := 0; attempt <= this.Retries; attempt++ {
+		if attempt > 0 {
+			fmt.Fprintln(this.stderr(), "Retrying hook in", wait, "Err=", err)
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return err
+			}
+			wait = wait * 2
+		}
+		if err = this.exec(batch); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (this *HookConfig) exec(batch []*Change) error {
+	if this.Func != nil {
+		return this.Func(batch)
+	}
+	keys := []string{}
+	stdin := new(bytes.Buffer)
+	for _, c := range batch {
+		keys = append(keys, c.Key)
+		fmt.Fprintln(stdin, c.Op, c.Key)
+	}
+	cmd := exec.Command("sh", "-c", this.Command)
+	cmd.Env = append(os.Environ(), "KVFS_CHANGED_KEYS="+strings.Join(keys, " "))
+	cmd.Stdin = stdin
+	cmd.Stdout = this.Stdout
+	cmd.Stderr = this.stderr()
+	return cmd.Run()
+}
+
+func (this *HookConfig) stderr() io.Writer {
+	if this.Stderr != nil {
+		return this.Stderr
+	}
+	return os.Stderr
+}